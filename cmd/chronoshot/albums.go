@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"chronoshot/pkg/db"
+)
+
+// albumInfo is an album as shown to a particular user.
+type albumInfo struct {
+	db.Album
+	Set    string // name to pass as ?set= to getAssetInfos and getSetArchive
+	Access string // owner, edit or read
+}
+
+func newAlbumInfo(a db.Album, userName string) albumInfo {
+	access := a.Shares[userName]
+	if a.Owner == userName {
+		access = "owner"
+	} else {
+		// Only the owner sees who else it is shared with.
+		a.Shares = nil
+	}
+	return albumInfo{a, "album:" + a.ID, access}
+}
+
+func writeAlbumError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, db.ErrAlbumNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, db.ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func getAlbumsHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	albums := []albumInfo{}
+	for _, a := range db.GetAlbums(user.Name) {
+		albums = append(albums, newAlbumInfo(a, user.Name))
+	}
+	writeJSON(w, http.StatusOK, albums)
+}
+
+type albumRequest struct {
+	Name string
+}
+
+func createAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	var req albumRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		http.Error(w, "album name required", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	user := currentUser(r)
+	album, err := db.CreateAlbum(user.Name, req.Name)
+	if err != nil {
+		writeAlbumError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newAlbumInfo(album, user.Name))
+}
+
+func renameAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	var req albumRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		http.Error(w, "album name required", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	user := currentUser(r)
+	album, err := db.UpdateAlbum(user.Name, r.PathValue("id"), func(a *db.Album) error {
+		a.Name = req.Name
+		return nil
+	})
+	if err != nil {
+		writeAlbumError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAlbumInfo(album, user.Name))
+}
+
+func deleteAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	if err := db.DeleteAlbum(currentUser(r).Name, r.PathValue("id")); err != nil {
+		writeAlbumError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type albumAssetsRequest struct {
+	AssetKeys []string
+}
+
+func addAlbumAssetsHandler(w http.ResponseWriter, r *http.Request) {
+	var req albumAssetsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	keyHashes := make([][]byte, len(req.AssetKeys))
+	for i, key := range req.AssetKeys {
+		keyHashes[i] = []byte(key)
+	}
+	if err := db.PutAlbumAssets(currentUser(r).Name, r.PathValue("id"), keyHashes, true); err != nil {
+		writeAlbumError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func removeAlbumAssetHandler(w http.ResponseWriter, r *http.Request) {
+	keyHashes := [][]byte{[]byte(r.PathValue("assetId"))}
+	if err := db.PutAlbumAssets(currentUser(r).Name, r.PathValue("id"), keyHashes, false); err != nil {
+		writeAlbumError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type shareRequest struct {
+	Access string // read or edit
+}
+
+func shareAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	var req shareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if req.Access != db.AccessRead && req.Access != db.AccessEdit {
+		http.Error(w, "access must be read or edit", http.StatusBadRequest)
+		return
+	}
+	shareWith := r.PathValue("user")
+	if _, ok := db.GetUser(shareWith); !ok {
+		http.Error(w, "unknown user", http.StatusBadRequest)
+		return
+	}
+
+	user := currentUser(r)
+	album, err := db.UpdateAlbum(user.Name, r.PathValue("id"), func(a *db.Album) error {
+		if shareWith == a.Owner {
+			return errors.New("cannot share an album with its owner")
+		}
+		a.Shares[shareWith] = req.Access
+		return nil
+	})
+	if err != nil {
+		writeAlbumError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAlbumInfo(album, user.Name))
+}
+
+func unshareAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	album, err := db.UpdateAlbum(user.Name, r.PathValue("id"), func(a *db.Album) error {
+		delete(a.Shares, r.PathValue("user"))
+		return nil
+	})
+	if err != nil {
+		writeAlbumError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAlbumInfo(album, user.Name))
+}
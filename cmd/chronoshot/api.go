@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"chronoshot/pkg/db"
+)
+
+// The /api/v1 routes present assets, sets, tags and jobs as resources. The
+// older routes registered in main remain as aliases for existing clients.
+func registerAPIv1() {
+	http.HandleFunc("/api/v1/", apiNotFoundHandler)
+	http.HandleFunc("GET /api/v1/openapi.json", openAPIHandler)
+
+	http.HandleFunc("GET /api/v1/assets", apiAssetsHandler)
+	http.HandleFunc("POST /api/v1/assets", apiAddAssetsHandler)
+	http.HandleFunc("POST /api/v1/assets/bulk", apiBulkHandler)
+	http.HandleFunc("GET /api/v1/assets/{id}", apiAssetHandler)
+	http.HandleFunc("GET /api/v1/assets/{id}/original", withAsset(serveAsset))
+	http.HandleFunc("GET /api/v1/assets/{id}/thumbnail", withAsset(serveThumbnail))
+	http.HandleFunc("GET /api/v1/assets/{id}/render", renderHandler)
+	http.HandleFunc("PUT /api/v1/assets/{id}/favourite", withAsset(apiFavouriteHandler))
+	http.HandleFunc("DELETE /api/v1/assets/{id}/favourite", withAsset(apiFavouriteHandler))
+	http.HandleFunc("PUT /api/v1/assets/{id}/rating", withAsset(apiRatingHandler))
+	http.HandleFunc("GET /api/v1/assets/{id}/caption", withAsset(apiCaptionHandler))
+	http.HandleFunc("PUT /api/v1/assets/{id}/caption", withAsset(apiCaptionHandler))
+	http.HandleFunc("PUT /api/v1/assets/{id}/date", withAsset(apiDateHandler))
+	http.HandleFunc("DELETE /api/v1/assets/{id}/date", withAsset(apiDateHandler))
+	http.HandleFunc("PUT /api/v1/assets/{id}/rotation", withAsset(apiRotationHandler))
+	http.HandleFunc("DELETE /api/v1/assets/{id}/rotation", withAsset(apiRotationHandler))
+	http.HandleFunc("PUT /api/v1/assets/{id}/trash", withAsset(apiTrashHandler))
+	http.HandleFunc("DELETE /api/v1/assets/{id}/trash", withAsset(apiTrashHandler))
+	http.HandleFunc("PUT /api/v1/assets/{id}/tags/{tag}", withAsset(apiAssetTagHandler))
+	http.HandleFunc("DELETE /api/v1/assets/{id}/tags/{tag}", withAsset(apiAssetTagHandler))
+
+	http.HandleFunc("GET /api/v1/sets", apiSetsHandler)
+	http.HandleFunc("GET /api/v1/sets/{set}/assets", apiSetAssetsHandler)
+	http.HandleFunc("GET /api/v1/sets/{set}/archive", withSetQuery(getSetArchiveHandler))
+
+	http.HandleFunc("GET /api/v1/search", searchHandler)
+
+	http.HandleFunc("GET /api/v1/tags", apiTagsHandler)
+	http.HandleFunc("GET /api/v1/trash", apiTrashListHandler)
+	http.HandleFunc("GET /api/v1/tags/{tag}/assets", apiTagAssetsHandler)
+
+	http.HandleFunc("OPTIONS /api/v1/uploads", withTus(uploadOptionsHandler))
+	http.HandleFunc("POST /api/v1/uploads", withTus(createUploadHandler))
+	http.HandleFunc("HEAD /api/v1/uploads/{id}", withTus(uploadOffsetHandler))
+	http.HandleFunc("GET /api/v1/uploads/{id}", withTus(getUploadHandler))
+	http.HandleFunc("PATCH /api/v1/uploads/{id}", withTus(patchUploadHandler))
+	http.HandleFunc("DELETE /api/v1/uploads/{id}", withTus(deleteUploadHandler))
+
+	http.HandleFunc("GET /api/v1/jobs", getJobsHandler)
+	http.HandleFunc("GET /api/v1/jobs/{id}", getJobHandler)
+	http.HandleFunc("POST /api/v1/jobs/regenerate", regenerateHandler)
+	http.HandleFunc("POST /api/v1/jobs/export", exportHandler)
+	http.HandleFunc("POST /api/v1/jobs/purge", purgeHandler)
+
+	http.HandleFunc("GET /api/v1/users", getUsersHandler)
+	http.HandleFunc("POST /api/v1/users", createUserHandler)
+	http.HandleFunc("PUT /api/v1/users/{name}/password", setPasswordHandler)
+}
+
+// apiError is the body of every error response from /api/v1.
+type apiError struct {
+	Error struct {
+		Status  int
+		Message string
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	var e apiError
+	e.Error.Status = status
+	e.Error.Message = message
+	w.Header().Del("X-Content-Type-Options")
+	writeJSON(w, status, e)
+}
+
+// apiErrorWriter holds back plain text error responses, as written by
+// http.Error, so that they can be replaced with an apiError.
+type apiErrorWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *apiErrorWriter) WriteHeader(status int) {
+	if status >= 400 && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		w.status = status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *apiErrorWriter) Write(b []byte) (int, error) {
+	if w.status != 0 {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *apiErrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withAPIErrors gives errors from /api/v1, including those from the mux
+// and requireAuth, a consistent JSON body.
+func withAPIErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ew := &apiErrorWriter{ResponseWriter: w}
+		next.ServeHTTP(ew, r)
+		if ew.status != 0 {
+			writeAPIError(w, ew.status, strings.TrimSpace(ew.body.String()))
+		}
+	})
+}
+
+var apiMethods = []string{"GET", "PUT", "POST", "DELETE"}
+
+// apiNotFoundHandler catches requests no /api/v1 route matches. Since it
+// matches any method, it also has to answer for routes that exist but not
+// for the method used.
+func apiNotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	var allowed []string
+	for _, method := range apiMethods {
+		probe := r.Clone(r.Context())
+		probe.Method = method
+		if _, pattern := http.DefaultServeMux.Handler(probe); pattern != "/api/v1/" {
+			allowed = append(allowed, method)
+		}
+	}
+	if len(allowed) == 0 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	http.Error(w, r.Method+" not allowed", http.StatusMethodNotAllowed)
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, path.Join("./static", "openapi.json"))
+}
+
+// withAsset checks the asset named in the path exists before calling h.
+func withAsset(h func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("id")
+		if !db.KeyExists([]byte(key)) {
+			http.Error(w, "asset not found", http.StatusNotFound)
+			return
+		}
+		h(w, r, key)
+	}
+}
+
+// withSetQuery passes the set named in the path on to handlers that take it
+// as a query parameter.
+func withSetQuery(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		q.Set("set", r.PathValue("set"))
+		r.URL.RawQuery = q.Encode()
+		h(w, r)
+	}
+}
+
+// withIDQuery passes the id query parameter of the original routes on to
+// handlers that take it from the path.
+func withIDQuery(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.SetPathValue("id", r.URL.Query().Get("id"))
+		h(w, r)
+	}
+}
+
+// withBodyAssetKey passes the AssetKey in the JSON body of the original
+// routes on to handlers that take it from the path, leaving the body for
+// them to read.
+func withBodyAssetKey(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		var req struct{ AssetKey string }
+		if err == nil {
+			err = json.Unmarshal(body, &req)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.SetPathValue("id", req.AssetKey)
+		h(w, r)
+	}
+}
+
+// withOKStatus answers 200 OK where h answers 204 No Content, as the
+// original routes always did.
+func withOKStatus(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(okStatusWriter{w}, r)
+	}
+}
+
+type okStatusWriter struct {
+	http.ResponseWriter
+}
+
+func (w okStatusWriter) WriteHeader(status int) {
+	if status == http.StatusNoContent {
+		status = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w okStatusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// writeSetAssets lists the assets in a set, limited by any from and to
+// query parameters.
+func writeSetAssets(w http.ResponseWriter, r *http.Request, setName string) {
+	dates, err := parseDateRange(r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	assets, err := assetsInSet(currentUser(r), setName, dates)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if assets == nil {
+		assets = []db.Asset{}
+	}
+	writeJSON(w, http.StatusOK, assets)
+}
+
+func apiAssetsHandler(w http.ResponseWriter, r *http.Request) {
+	setName := r.URL.Query().Get("set")
+	if setName == "" {
+		setName = "all"
+	}
+	writeSetAssets(w, r, setName)
+}
+
+func apiSetAssetsHandler(w http.ResponseWriter, r *http.Request) {
+	writeSetAssets(w, r, r.PathValue("set"))
+}
+
+func apiTagAssetsHandler(w http.ResponseWriter, r *http.Request) {
+	writeSetAssets(w, r, "tag:"+r.PathValue("tag"))
+}
+
+// assetResource is an asset as seen by the user requesting it.
+type assetResource struct {
+	AssetKey         string
+	DateTime         time.Time    // in the zone the asset was taken in
+	UTCDateTime      time.Time    // the same instant in UTC
+	LocalDateTime    string       // the wall-clock time where it was taken
+	TimeZone         string       // where the file's zone came from: offset, gps or default
+	OriginalDateTime *time.Time   `json:",omitempty"` // set if DateTime has been corrected
+	Rotation         *db.Rotation `json:",omitempty"` // set if it replaces the EXIF orientation
+	IsSelected       bool
+	Rating           int
+	Tags             []string
+	Caption          string
+	Description      string
+}
+
+func apiAssetHandler(w http.ResponseWriter, r *http.Request) {
+	key := []byte(r.PathValue("id"))
+	if !db.KeyExists(key) {
+		http.Error(w, "asset not found", http.StatusNotFound)
+		return
+	}
+	caption, err := db.GetAssetCaption(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	original, err := db.GetOriginalDateTime(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	meta, err := db.GetAssetMeta(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	user := currentUser(r)
+	dateTime := db.GetDateTime(key)
+	resource := assetResource{
+		AssetKey:      string(key),
+		DateTime:      dateTime,
+		UTCDateTime:   dateTime.UTC(),
+		LocalDateTime: dateTime.Format("2006-01-02T15:04:05"),
+		TimeZone:      meta.TimeZone,
+		IsSelected:    db.GetIsSelected(user.Name, key),
+		Rating:        db.GetRating(user.Name, key),
+		Tags:          db.GetAssetTags(key),
+		Caption:       caption.Caption,
+		Description:   caption.Description,
+		Rotation:      assetRotation(string(key)),
+	}
+	if !resource.DateTime.Equal(original) {
+		resource.OriginalDateTime = &original
+	}
+	writeJSON(w, http.StatusOK, resource)
+}
+
+// apiFavouriteHandler adds the asset to the user's favourites on PUT and
+// removes it on DELETE.
+func apiFavouriteHandler(w http.ResponseWriter, r *http.Request, key string) {
+	setFavourite(w, r, key, r.Method == "PUT")
+}
+
+func setFavourite(w http.ResponseWriter, r *http.Request, key string, selected bool) {
+	db.PutSelection(currentUser(r).Name, []byte(key), selected)
+	queueUserSidecarWrites(currentUser(r).Name, key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiRatingHandler(w http.ResponseWriter, r *http.Request, key string) {
+	var req struct{ Rating int }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if req.Rating < 0 || req.Rating > 5 {
+		http.Error(w, "rating must be between 0 and 5", http.StatusBadRequest)
+		return
+	}
+	db.PutRating(currentUser(r).Name, []byte(key), req.Rating)
+	queueUserSidecarWrites(currentUser(r).Name, key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiCaptionHandler returns the asset's caption and description on GET and
+// replaces both on PUT.
+func apiCaptionHandler(w http.ResponseWriter, r *http.Request, key string) {
+	if r.Method == "PUT" {
+		var req db.AssetCaption
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+		caption, err := db.NormaliseCaption(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := db.PutAssetCaption([]byte(key), caption); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		queueSidecarWrites(key)
+	}
+
+	caption, err := db.GetAssetCaption([]byte(key))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, caption)
+}
+
+// apiDateHandler corrects the date the asset was taken on PUT and restores
+// the date read from the file on DELETE.
+func apiDateHandler(w http.ResponseWriter, r *http.Request, key string) {
+	var dateTime time.Time
+	if r.Method == "PUT" {
+		var req struct{ DateTime string }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+		var err error
+		if dateTime, err = time.Parse(time.RFC3339, req.DateTime); err != nil {
+			http.Error(w, "DateTime must be RFC 3339", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := db.PutAssetDateTime([]byte(key), dateTime); err != nil {
+		if err == db.ErrAssetNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiAssetTagHandler tags the asset on PUT and untags it on DELETE.
+func apiAssetTagHandler(w http.ResponseWriter, r *http.Request, key string) {
+	tag, err := db.NormaliseTag(r.PathValue("tag"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := db.PutAssetTag([]byte(key), tag, r.Method == "PUT"); err != nil {
+		if err == db.ErrAssetNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	queueSidecarWrites(key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setInfo describes a set the user can use as "set" anywhere one is taken.
+type setInfo struct {
+	Name  string
+	Kind  string // all, selections, album, smart, tag or trash
+	Title string
+	Count int
+}
+
+func apiSetsHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	sizes, err := db.GetSetSizes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sets := []setInfo{
+		{Name: "all", Kind: "all", Title: "All", Count: sizes["all"]},
+		{Name: "selections", Kind: "selections", Title: "Favourites", Count: sizes["selections:"+user.Name]},
+	}
+	albums := db.GetAlbums(user.Name)
+	sort.Slice(albums, func(i, k int) bool { return albums[i].Name < albums[k].Name })
+	for _, a := range albums {
+		sets = append(sets, setInfo{Name: "album:" + a.ID, Kind: "album", Title: a.Name, Count: sizes["album:"+a.ID]})
+	}
+	smartAlbums := db.GetSmartAlbums(user.Name)
+	sort.Slice(smartAlbums, func(i, k int) bool { return smartAlbums[i].Name < smartAlbums[k].Name })
+	for _, a := range smartAlbums {
+		// A saved query that no longer parses is listed as empty rather
+		// than failing every set.
+		assets, _ := assetsInSet(user, "smart:"+a.ID, dateRange{})
+		sets = append(sets, setInfo{Name: "smart:" + a.ID, Kind: "smart", Title: a.Name, Count: len(assets)})
+	}
+	for _, t := range sortedTags() {
+		sets = append(sets, setInfo{Name: "tag:" + t.Name, Kind: "tag", Title: t.Name, Count: t.Count})
+	}
+	sets = append(sets, setInfo{Name: "trash", Kind: "trash", Title: "Trash", Count: sizes["trash"]})
+	writeJSON(w, http.StatusOK, sets)
+}
+
+type tagInfo struct {
+	Name  string
+	Count int
+}
+
+func sortedTags() []tagInfo {
+	tags := []tagInfo{}
+	for name, count := range db.GetTags() {
+		tags = append(tags, tagInfo{name, count})
+	}
+	sort.Slice(tags, func(i, k int) bool { return tags[i].Name < tags[k].Name })
+	return tags
+}
+
+func apiTagsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, sortedTags())
+}
+
+// bulkQuery selects assets by set and date, as an alternative to listing
+// their keys.
+type bulkQuery struct {
+	Set  string
+	From string
+	To   string
+}
+
+type bulkRequest struct {
+	AssetKeys []string
+	Query     *bulkQuery
+	ShiftDate string // e.g. "+1y -3h"
+	db.BulkChange
+}
+
+// apiBulkHandler applies favourite, rating, tag, album and date changes to
+// many assets at once, either all of them or, on error, none.
+func apiBulkHandler(w http.ResponseWriter, r *http.Request) {
+	var req bulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	user := currentUser(r)
+	keys := req.AssetKeys
+	switch {
+	case (len(req.AssetKeys) == 0) == (req.Query == nil):
+		http.Error(w, "exactly one of AssetKeys and Query is required", http.StatusBadRequest)
+		return
+	case req.Query != nil:
+		dates, err := parseDateRange(req.Query.From, req.Query.To)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		setName := req.Query.Set
+		if setName == "" {
+			setName = "all"
+		}
+		assets, err := assetsInSet(user, setName, dates)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		for _, asset := range assets {
+			keys = append(keys, asset.AssetKey)
+		}
+	}
+
+	c := req.BulkChange
+	if req.ShiftDate != "" {
+		shift, err := parseDateShift(req.ShiftDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.ShiftDate = &shift
+	}
+	if c.Rating != nil && (*c.Rating < 0 || *c.Rating > 5) {
+		http.Error(w, "rating must be between 0 and 5", http.StatusBadRequest)
+		return
+	}
+	for _, tags := range [][]string{c.AddTags, c.RemoveTags} {
+		for i, tag := range tags {
+			normalised, err := db.NormaliseTag(tag)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			tags[i] = normalised
+		}
+	}
+
+	keyHashes := make([][]byte, len(keys))
+	for i, key := range keys {
+		keyHashes[i] = []byte(key)
+	}
+	if err := db.ApplyBulkChange(user.Name, keyHashes, c); err != nil {
+		switch err {
+		case db.ErrAssetNotFound, db.ErrAlbumNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case db.ErrForbidden:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	// A change to a whole set can fill the sidecar queue, so it is queued in
+	// the background rather than holding up the response.
+	if len(c.AddTags) > 0 || len(c.RemoveTags) > 0 {
+		background.Go(func() { queueSidecarWrites(keys...) })
+	} else if c.Favourite != nil || c.Rating != nil {
+		background.Go(func() { queueUserSidecarWrites(user.Name, keys...) })
+	}
+	requestLogger(r).Info("Applied bulk change", "assets", len(keys))
+	writeJSON(w, http.StatusOK, map[string]int{"Count": len(keys)})
+}
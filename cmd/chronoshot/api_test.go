@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"chronoshot/pkg/db"
+	"chronoshot/pkg/db/dbtest"
+)
+
+// testAsset opens a new database for the rest of the test, holding one
+// asset, whose key it returns.
+func testAsset(t *testing.T) string {
+	dbtest.Open(t)
+	return string(dbtest.PutAsset("/photos/a.jpg", time.Now(), db.AssetMeta{}))
+}
+
+// serveAs runs h for a request from the named user.
+func serveAs(user string, h http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), userContextKey, db.User{Name: user}))
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestLegacySelect(t *testing.T) {
+	key := testAsset(t)
+	post := withOKStatus(withBodyAssetKey(withAsset(selectHandler)))
+	get := withIDQuery(withAsset(getSelectionHandler))
+
+	if w := serveAs("alice", post, "POST", "/select/", `{"assetKey":"`+key+`","isSelected":true}`); w.Code != http.StatusOK {
+		t.Fatalf("POST: status %d: %s", w.Code, w.Body)
+	}
+	db.Sync()
+	if w := serveAs("alice", get, "GET", "/select/?id="+key, ""); strings.TrimSpace(w.Body.String()) != `{"isSelected":true}` {
+		t.Errorf("GET: %s", w.Body)
+	}
+	if w := serveAs("bob", get, "GET", "/select/?id="+key, ""); strings.TrimSpace(w.Body.String()) != `{"isSelected":false}` {
+		t.Errorf("GET as someone else: %s", w.Body)
+	}
+
+	for body, want := range map[string]int{
+		`{"AssetKey":`: http.StatusBadRequest,
+		`{"AssetKey":"` + key + `","IsSelected":"yes"}`: http.StatusBadRequest,
+		`{"AssetKey":"missing","IsSelected":true}`:      http.StatusNotFound,
+	} {
+		if w := serveAs("alice", post, "POST", "/select/", body); w.Code != want {
+			t.Errorf("POST %s: status %d, want %d", body, w.Code, want)
+		}
+	}
+}
+
+func TestLegacyRate(t *testing.T) {
+	key := testAsset(t)
+	post := withOKStatus(withBodyAssetKey(withAsset(apiRatingHandler)))
+	get := withIDQuery(withAsset(getRatingHandler))
+
+	if w := serveAs("alice", post, "POST", "/rate/", `{"AssetKey":"`+key+`","Rating":4}`); w.Code != http.StatusOK {
+		t.Fatalf("POST: status %d: %s", w.Code, w.Body)
+	}
+	db.Sync()
+	if w := serveAs("alice", get, "GET", "/rate/?id="+key, ""); strings.TrimSpace(w.Body.String()) != `{"rating":4}` {
+		t.Errorf("GET: %s", w.Body)
+	}
+	if w := serveAs("alice", get, "GET", "/rate/?id=missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET of a missing asset: status %d", w.Code)
+	}
+
+	for body, want := range map[string]int{
+		`not json`:                              http.StatusBadRequest,
+		`{"AssetKey":"` + key + `","Rating":6}`: http.StatusBadRequest,
+		`{"AssetKey":"missing","Rating":3}`:     http.StatusNotFound,
+	} {
+		if w := serveAs("alice", post, "POST", "/rate/", body); w.Code != want {
+			t.Errorf("POST %s: status %d, want %d", body, w.Code, want)
+		}
+	}
+}
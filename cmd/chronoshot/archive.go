@@ -0,0 +1,254 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"chronoshot/pkg/db"
+)
+
+// Naming templates for archive and export entries. Templates may use
+// {yyyy}, {mm}, {dd}, {hh}, {min}, {ss} from the capture time, and {name},
+// {stem} and {ext} from the original file name.
+const (
+	flatTemplate  = "{name}"
+	datedTemplate = "{yyyy}/{mm}/{name}"
+)
+
+// archiveNamer picks entry names for an archive from a naming template,
+// numbering any that would otherwise collide.
+type archiveNamer struct {
+	template string
+	used     map[string]bool
+}
+
+func newArchiveNamer(template string) (*archiveNamer, error) {
+	if !strings.Contains(template, "{name}") && !strings.Contains(template, "{stem}") {
+		return nil, fmt.Errorf("naming template %q must include {name} or {stem}", template)
+	}
+	return &archiveNamer{template, make(map[string]bool)}, nil
+}
+
+// Name returns the entry name for the file at path, taken at dateTime, and
+// reserves the name of its sidecar with it.
+func (n *archiveNamer) Name(path string, dateTime time.Time) string {
+	base := filepath.Base(path)
+	ext := filepath.Ext(base)
+	name := strings.NewReplacer(
+		"{yyyy}", dateTime.Format("2006"),
+		"{mm}", dateTime.Format("01"),
+		"{dd}", dateTime.Format("02"),
+		"{hh}", dateTime.Format("15"),
+		"{min}", dateTime.Format("04"),
+		"{ss}", dateTime.Format("05"),
+		"{name}", base,
+		"{stem}", strings.TrimSuffix(base, ext),
+		"{ext}", strings.TrimPrefix(ext, "."),
+	).Replace(n.template)
+
+	// Keep entries inside the archive or export directory.
+	var parts []string
+	for _, part := range strings.Split(name, "/") {
+		if part != "" && part != "." && part != ".." {
+			parts = append(parts, part)
+		}
+	}
+	return n.reserve(strings.Join(parts, "/"), true)
+}
+
+// Unique returns name, numbered if it has already been used.
+func (n *archiveNamer) Unique(name string) string {
+	return n.reserve(name, false)
+}
+
+// Keep marks name, and its sidecar's name, as used without numbering them,
+// so that an entry written by an interrupted export keeps its name however
+// the set has changed since.
+func (n *archiveNamer) Keep(name string) {
+	n.used[strings.ToLower(name)] = true
+	n.used[strings.ToLower(sidecarName(name))] = true
+}
+
+// reserve numbers name until it is unused, along with its sidecar's name if
+// withSidecar is set, and marks them used.
+func (n *archiveNamer) reserve(name string, withSidecar bool) string {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+
+	// Compare case-insensitively so that archives extract cleanly on
+	// case-insensitive file systems.
+	used := func(name string) bool {
+		return n.used[strings.ToLower(name)] || withSidecar && n.used[strings.ToLower(sidecarName(name))]
+	}
+	unique := name
+	for i := 1; used(unique); i++ {
+		unique = fmt.Sprintf("%s_%d%s", stem, i, ext)
+	}
+	n.used[strings.ToLower(unique)] = true
+	if withSidecar {
+		n.used[strings.ToLower(sidecarName(unique))] = true
+	}
+	return unique
+}
+
+// sidecarName returns the name of the XMP sidecar for an archive entry, such
+// as photo.jpg.xmp, as darktable and digiKam name them. Name has already
+// reserved it, so a.jpg and a.jpeg keep sidecars that match them.
+func sidecarName(name string) string {
+	return name + ".xmp"
+}
+
+// assetSidecar returns an XMP sidecar for the asset's caption and tags, or
+// nil if it has neither.
+func assetSidecar(keyHash string) []byte {
+	c, err := db.GetAssetCaption([]byte(keyHash))
+	if err != nil {
+		return nil
+	}
+	tags := db.GetAssetTags([]byte(keyHash))
+	if c.Caption == "" && c.Description == "" && len(tags) == 0 {
+		return nil
+	}
+	sidecar, err := updateXMP(nil, xmpProps{Caption: &c.Caption, Description: &c.Description, Keywords: &tags})
+	if err != nil {
+		return nil
+	}
+	return sidecar
+}
+
+// isCompressed reports whether the file at path is already compressed, in
+// which case deflating it again only costs time.
+func isCompressed(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".mp4", ".mov", ".heic", ".zip":
+		return true
+	}
+	return false
+}
+
+// addFileToZip adds the file at path as name. Entries cannot be taken back,
+// so once its header is written a failure leaves an incomplete entry, which
+// the error says.
+func addFileToZip(zipWriter *zip.Writer, path string, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return errors.New("not a regular file")
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	if isCompressed(path) {
+		header.Method = zip.Store
+	}
+	headerWriter, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(headerWriter, file)
+	if err == nil && n != info.Size() {
+		err = fmt.Errorf("read %d bytes of %d", n, info.Size())
+	}
+	if err != nil {
+		return fmt.Errorf("%s is incomplete in this archive: %w", name, err)
+	}
+	return nil
+}
+
+// getSetArchiveHandler streams a zip of the originals in a set, optionally
+// limited to a date range (from, to) and arranged in dated folders
+// (folders=date) or by a naming template (template=). Captions and tags are
+// added as XMP sidecars. Files that cannot be read are skipped, or left
+// incomplete if reading fails part way, and listed in an errors.txt entry at
+// the end of the archive.
+func getSetArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	setName := q.Get("set")
+	if setName == "" {
+		setName = "all"
+	}
+	dates, err := parseDateRange(q.Get("from"), q.Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	template := q.Get("template")
+	if template == "" {
+		template = flatTemplate
+		if q.Get("folders") == "date" {
+			template = datedTemplate
+		}
+	}
+	namer, err := newArchiveNamer(template)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	assets, err := assetsInSet(currentUser(r), setName, dates)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", setName+".zip"))
+	zipWriter := zip.NewWriter(w)
+	defer zipWriter.Close()
+
+	var failures []string
+	for _, asset := range assets {
+		assetPath := string(db.GetAssetPath([]byte(asset.AssetKey)))
+		name := namer.Name(assetPath, asset.DateTime)
+		if err := addFileToZip(zipWriter, assetPath, name); err != nil {
+			requestLogger(r).Warn("Could not add to archive", "path", assetPath, "err", err)
+			failures = append(failures, assetPath+": "+err.Error())
+			if r.Context().Err() != nil {
+				// Client has gone away.
+				return
+			}
+			continue
+		}
+		if sidecar := assetSidecar(asset.AssetKey); sidecar != nil {
+			f, err := zipWriter.CreateHeader(&zip.FileHeader{
+				Name:     sidecarName(name),
+				Method:   zip.Deflate,
+				Modified: time.Now(),
+			})
+			if err == nil {
+				_, err = f.Write(sidecar)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		f, err := zipWriter.CreateHeader(&zip.FileHeader{
+			Name:     namer.Unique("errors.txt"),
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		})
+		if err == nil {
+			io.WriteString(f, "The following files could not be added to this archive, or are incomplete in it:\n\n"+strings.Join(failures, "\n")+"\n")
+		}
+	}
+}
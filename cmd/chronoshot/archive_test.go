@@ -0,0 +1,127 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchiveNamer(t *testing.T) {
+	taken := time.Date(2023, 6, 1, 14, 5, 9, 0, time.UTC)
+	tests := []struct {
+		template string
+		path     string
+		want     string
+	}{
+		{flatTemplate, "/photos/a/IMG_1.jpg", "IMG_1.jpg"},
+		{datedTemplate, "/photos/a/IMG_1.jpg", "2023/06/IMG_1.jpg"},
+		{"{yyyy}{mm}{dd}_{hh}{min}{ss}_{stem}.{ext}", "/photos/a/IMG_1.JPG", "20230601_140509_IMG_1.JPG"},
+		{"../{yyyy}//./{name}", "/photos/a/IMG_1.jpg", "2023/IMG_1.jpg"},
+	}
+	for _, test := range tests {
+		namer, err := newArchiveNamer(test.template)
+		if err != nil {
+			t.Fatalf("%s: %v", test.template, err)
+		}
+		if got := namer.Name(test.path, taken); got != test.want {
+			t.Errorf("%s: Name(%q) = %q, want %q", test.template, test.path, got, test.want)
+		}
+	}
+
+	if _, err := newArchiveNamer("{yyyy}/{mm}"); err == nil {
+		t.Error("a template without {name} or {stem} was accepted")
+	}
+}
+
+func TestArchiveNamerCollisions(t *testing.T) {
+	namer, err := newArchiveNamer("{stem}.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var taken time.Time
+	for _, test := range []struct{ path, want string }{
+		{"/photos/a/IMG_1.jpg", "IMG_1.jpg"},
+		{"/photos/b/IMG_1.jpg", "IMG_1_1.jpg"},
+		{"/photos/c/img_1.JPG", "img_1_2.jpg"},
+		{"/photos/d/IMG_1_1.jpg", "IMG_1_1_1.jpg"},
+	} {
+		if got := namer.Name(test.path, taken); got != test.want {
+			t.Errorf("Name(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+	if got := namer.Unique("errors.txt"); got != "errors.txt" {
+		t.Errorf("Unique(errors.txt) = %q", got)
+	}
+	if got := namer.Unique("ERRORS.TXT"); got != "ERRORS_1.TXT" {
+		t.Errorf("Unique(ERRORS.TXT) = %q", got)
+	}
+}
+
+func TestArchiveNamerSidecars(t *testing.T) {
+	namer, err := newArchiveNamer(flatTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var taken time.Time
+	// Photos that only differ in their extension keep their own sidecars.
+	for _, test := range []struct{ path, want, wantSidecar string }{
+		{"/photos/a.jpg", "a.jpg", "a.jpg.xmp"},
+		{"/photos/a.jpeg", "a.jpeg", "a.jpeg.xmp"},
+		{"/photos/x/a.jpg", "a_1.jpg", "a_1.jpg.xmp"},
+		// Already taken as the sidecar of a.jpg.
+		{"/photos/a.jpg.xmp", "a.jpg_1.xmp", "a.jpg_1.xmp.xmp"},
+	} {
+		name := namer.Name(test.path, taken)
+		if name != test.want || sidecarName(name) != test.wantSidecar {
+			t.Errorf("Name(%q) = %q with sidecar %q, want %q with %q",
+				test.path, name, sidecarName(name), test.want, test.wantSidecar)
+		}
+	}
+	if got := namer.Unique("A.JPEG.XMP"); got != "A.JPEG_1.XMP" {
+		t.Errorf("Unique(A.JPEG.XMP) = %q, want A.JPEG_1.XMP", got)
+	}
+}
+
+func TestAddFileToZip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.jpg")
+	if err := os.WriteFile(path, []byte("photo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	if err := addFileToZip(zipWriter, path, "2023/a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	// Rejected before anything is written for it.
+	if err := addFileToZip(zipWriter, dir, "dir"); err == nil {
+		t.Error("a directory was added")
+	}
+	if err := addFileToZip(zipWriter, filepath.Join(dir, "missing.jpg"), "missing.jpg"); err == nil {
+		t.Error("a missing file was added")
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zipReader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zipReader.File) != 1 || zipReader.File[0].Name != "2023/a.jpg" {
+		t.Fatalf("entries %v, want only 2023/a.jpg", zipReader.File)
+	}
+	f, err := zipReader.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if b, err := io.ReadAll(f); err != nil || string(b) != "photo" {
+		t.Errorf("entry holds %q, %v", b, err)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"chronoshot/pkg/db"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+const sessionCookieName = "chronoshot_session"
+const sessionLifetime = 30 * 24 * time.Hour
+
+// Compared against when a login names an unknown user, so that failed logins
+// take the same time whether or not the user exists.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("chronoshot"), bcrypt.DefaultCost)
+
+type contextKey int
+
+const userContextKey contextKey = 0
+
+// publicPaths are served without signing in, as is everything under /s/,
+// which checks share link tokens instead.
+var publicPaths = map[string]bool{
+	"/login":               true,
+	"/login.html":          true,
+	"/healthz":             true,
+	"/readyz":              true,
+	"/api/v1/openapi.json": true,
+}
+
+// isAdminPath reports whether only admins may use path.
+func isAdminPath(path string) bool {
+	return strings.HasPrefix(path, "/admin/") ||
+		path == "/api/v1/jobs" || strings.HasPrefix(path, "/api/v1/jobs/") ||
+		path == "/api/v1/users" || strings.HasPrefix(path, "/api/v1/users/")
+}
+
+// requireAuth only lets signed in users, or API tokens with the scope a
+// request needs, through to next, and only admins through to admin paths.
+// The user is available to handlers via currentUser.
+func requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPaths[r.URL.Path] || strings.HasPrefix(r.URL.Path, "/s/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if _, hasBearer := bearerToken(r); hasBearer {
+			user, token, ok := authenticateToken(r)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="chronoshot"`)
+				http.Error(w, "invalid or expired token", http.StatusUnauthorized)
+				return
+			}
+			if strings.HasPrefix(r.URL.Path, "/api/tokens") {
+				http.Error(w, "tokens can only be managed when signed in", http.StatusForbidden)
+				return
+			}
+			if scope := requiredScope(r); !token.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="chronoshot", error="insufficient_scope", scope="`+scope+`"`)
+				http.Error(w, "token lacks the "+scope+" scope", http.StatusForbidden)
+				return
+			}
+			if isAdminPath(r.URL.Path) && !user.IsAdmin {
+				http.Error(w, "admin access required", http.StatusForbidden)
+				return
+			}
+			setRequestUser(r, user.Name)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+			return
+		}
+
+		user, ok := authenticate(r)
+		if !ok {
+			if r.Method == "GET" && (r.URL.Path == "/" || strings.HasSuffix(r.URL.Path, ".html")) {
+				http.Redirect(w, r, "/login.html", http.StatusSeeOther)
+				return
+			}
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		if isAdminPath(r.URL.Path) && !user.IsAdmin {
+			http.Error(w, "admin access required", http.StatusForbidden)
+			return
+		}
+
+		setRequestUser(r, user.Name)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+	})
+}
+
+func authenticate(r *http.Request) (db.User, bool) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return db.User{}, false
+	}
+	session, ok := db.GetSession(hashToken(cookie.Value))
+	if !ok {
+		return db.User{}, false
+	}
+	return db.GetUser(session.UserName)
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+func authenticateToken(r *http.Request) (db.User, db.APIToken, bool) {
+	value, _ := bearerToken(r)
+	tokenHash := hashToken(value)
+	token, ok := db.GetAPIToken(tokenHash)
+	if !ok {
+		return db.User{}, db.APIToken{}, false
+	}
+	user, ok := db.GetUser(token.UserName)
+	if !ok {
+		return db.User{}, db.APIToken{}, false
+	}
+	db.TouchAPIToken(tokenHash, time.Now())
+	return user, token, true
+}
+
+// requiredScope is the scope a token needs for r: admin for admin paths, read to
+// look and write to change anything else.
+func requiredScope(r *http.Request) string {
+	switch {
+	case isAdminPath(r.URL.Path):
+		return db.ScopeAdmin
+	case r.Method == "GET" || r.Method == "HEAD":
+		return db.ScopeRead
+	}
+	return db.ScopeWrite
+}
+
+// currentUser returns the signed in user making the request.
+func currentUser(r *http.Request) db.User {
+	user, _ := r.Context().Value(userContextKey).(db.User)
+	return user
+}
+
+func newToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+func checkPassword(name string, password string) (db.User, bool) {
+	user, ok := db.GetUser(name)
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return db.User{}, false
+	}
+	if bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(password)) != nil {
+		return db.User{}, false
+	}
+	return user, true
+}
+
+type credentials struct {
+	Name     string
+	Password string
+}
+
+// loginHandler accepts either a JSON body or the form in login.html.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	isJSON := strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	var c credentials
+	if isJSON {
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+	} else {
+		c.Name, c.Password = r.FormValue("name"), r.FormValue("password")
+	}
+
+	user, ok := checkPassword(c.Name, c.Password)
+	if !ok {
+		requestLogger(r).Warn("Failed login", "name", c.Name, "remote", r.RemoteAddr)
+		if isJSON {
+			http.Error(w, "invalid name or password", http.StatusUnauthorized)
+		} else {
+			http.Redirect(w, r, "/login.html?failed=1", http.StatusSeeOther)
+		}
+		return
+	}
+
+	token := newToken()
+	expires := time.Now().Add(sessionLifetime)
+	db.PutSession(hashToken(token), db.Session{UserName: user.Name, Expires: expires})
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	if isJSON {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		db.DeleteSession(hashToken(cookie.Value))
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/login.html", http.StatusSeeOther)
+}
+
+// readPassword prompts for a password without echoing it, or reads a line
+// from stdin when it is not a terminal, e.g. in scripts.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Print("Password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	fmt.Print("Repeat password: ")
+	repeated, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	if string(password) != string(repeated) {
+		return "", errors.New("passwords do not match")
+	}
+	return string(password), nil
+}
+
+func hashPassword(password string) ([]byte, error) {
+	if len(password) < 8 {
+		return nil, errors.New("password must be at least 8 characters")
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// addUserCommand implements "chronoshot adduser [-admin] <name>".
+func addUserCommand(args []string) {
+	fs := flag.NewFlagSet("adduser", flag.ExitOnError)
+	isAdmin := fs.Bool("admin", false, "allow the user to administer chronoshot")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: chronoshot adduser [-admin] <name>")
+		os.Exit(2)
+	}
+
+	initCommandDB("an admin can add users with POST /api/v1/users")
+
+	password, err := readPassword()
+	if err == nil {
+		var hash []byte
+		if hash, err = hashPassword(password); err == nil {
+			err = db.CreateUser(db.User{Name: fs.Arg(0), PasswordHash: hash, IsAdmin: *isAdmin, Created: time.Now()})
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println("Created user", fs.Arg(0))
+}
+
+// passwdCommand implements "chronoshot passwd <name>".
+func passwdCommand(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: chronoshot passwd <name>")
+		os.Exit(2)
+	}
+
+	initCommandDB("an admin can change passwords with PUT /api/v1/users/{name}/password")
+
+	password, err := readPassword()
+	if err == nil {
+		var hash []byte
+		if hash, err = hashPassword(password); err == nil {
+			err = db.SetPassword(args[0], hash)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println("Changed password for", args[0])
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+var timeZone = flag.String("time-zone", "", "zone, such as Europe/London, for photos that record no UTC offset or GPS time (default the server's)")
+
+// defaultZone is where photos are taken if they do not say otherwise.
+var defaultZone = time.Local
+
+// setupTimeZone resolves -time-zone.
+func setupTimeZone() {
+	if *timeZone == "" {
+		return
+	}
+	loc, err := time.LoadLocation(*timeZone)
+	if err != nil {
+		log.Fatalf("-time-zone: %v", err)
+	}
+	defaultZone = loc
+}
+
+// goexif does not know the EXIF 2.31 offset tags, which phones write with
+// the local time to say which zone it is in.
+const (
+	offsetTime          exif.FieldName = "OffsetTime"
+	offsetTimeOriginal  exif.FieldName = "OffsetTimeOriginal"
+	offsetTimeDigitized exif.FieldName = "OffsetTimeDigitized"
+)
+
+var offsetTimeFields = map[uint16]exif.FieldName{
+	0x9010: offsetTime,
+	0x9011: offsetTimeOriginal,
+	0x9012: offsetTimeDigitized,
+}
+
+func init() {
+	exif.RegisterParsers(offsetTimeParser{})
+}
+
+// offsetTimeParser loads the offset tags from the EXIF sub-IFD, which the
+// default parser has already found.
+type offsetTimeParser struct{}
+
+func (offsetTimeParser) Parse(x *exif.Exif) error {
+	tag, err := x.Get(exif.ExifIFDPointer)
+	if err != nil {
+		return nil
+	}
+	offset, err := tag.Int64(0)
+	if err != nil {
+		return nil
+	}
+	r := bytes.NewReader(x.Raw)
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return nil
+	}
+	dir, _, err := tiff.DecodeDir(r, x.Tiff.Order)
+	if err != nil {
+		return nil
+	}
+	x.LoadTags(dir, offsetTimeFields, false)
+	return nil
+}
+
+// Where the zone of a capture time came from.
+const (
+	zoneFromOffset  = "offset"
+	zoneFromGPS     = "gps"
+	zoneFromDefault = "default"
+)
+
+// captureTime returns when the photo was taken, in the zone it was taken
+// in, and where that zone came from. EXIF dates are wall-clock times, so the
+// zone is the offset recorded with them, else the difference from the GPS
+// time in UTC, else defaultZone.
+func captureTime(x *exif.Exif) (time.Time, string, error) {
+	const layout = "2006:01:02 15:04:05"
+	field, offsetField := exif.DateTimeOriginal, offsetTimeOriginal
+	s := exifString(x, field)
+	if s == "" {
+		field, offsetField = exif.DateTime, offsetTime
+		s = exifString(x, field)
+	}
+	wall, err := time.Parse(layout, s)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+
+	for _, name := range []exif.FieldName{offsetField, offsetTime} {
+		if offset, err := time.Parse("-07:00", exifString(x, name)); err == nil {
+			_, seconds := offset.Zone()
+			return inZone(wall, time.FixedZone("", seconds)), zoneFromOffset, nil
+		}
+	}
+
+	if utc, ok := gpsTime(x); ok {
+		// The fix may be a little older than the photo, and zones are
+		// whole quarter hours.
+		offset := wall.Sub(utc).Round(15 * time.Minute)
+		if offset.Abs() <= 14*time.Hour {
+			return inZone(wall, time.FixedZone("", int(offset.Seconds()))), zoneFromGPS, nil
+		}
+	}
+
+	return inZone(wall, defaultZone), zoneFromDefault, nil
+}
+
+// inZone returns the time with the same wall clock as t in loc.
+func inZone(t time.Time, loc *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+}
+
+// gpsTime returns the UTC time of the GPS fix recorded with a photo.
+func gpsTime(x *exif.Exif) (time.Time, bool) {
+	date, err := time.Parse("2006:01:02", strings.TrimSpace(exifString(x, exif.GPSDateStamp)))
+	if err != nil {
+		return time.Time{}, false
+	}
+	tag, err := x.Get(exif.GPSTimeStamp)
+	if err != nil || tag.Count < 3 {
+		return time.Time{}, false
+	}
+	var seconds float64
+	for i, unit := range []float64{3600, 60, 1} {
+		r, err := tag.Rat(i)
+		if err != nil {
+			return time.Time{}, false
+		}
+		f, _ := r.Float64()
+		seconds += f * unit
+	}
+	return date.Add(time.Duration(seconds * float64(time.Second))), true
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// ifdEntry is a TIFF directory entry with its value already encoded.
+type ifdEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+}
+
+func asciiEntry(tag uint16, s string) ifdEntry {
+	return ifdEntry{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func rationalEntry(tag uint16, rats ...[2]uint32) ifdEntry {
+	var b []byte
+	for _, r := range rats {
+		b = binary.LittleEndian.AppendUint32(b, r[0])
+		b = binary.LittleEndian.AppendUint32(b, r[1])
+	}
+	return ifdEntry{tag, 5, uint32(len(rats)), b}
+}
+
+func longEntry(tag uint16, n int) ifdEntry {
+	return ifdEntry{tag, 4, 1, binary.LittleEndian.AppendUint32(nil, uint32(n))}
+}
+
+// appendIFD appends a directory, followed by the values that do not fit in
+// its entries, to the little-endian TIFF in b.
+func appendIFD(b []byte, entries []ifdEntry) []byte {
+	valueOffset := len(b) + 2 + 12*len(entries) + 4
+	var values []byte
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(entries)))
+	for _, e := range entries {
+		b = binary.LittleEndian.AppendUint16(b, e.tag)
+		b = binary.LittleEndian.AppendUint16(b, e.typ)
+		b = binary.LittleEndian.AppendUint32(b, e.count)
+		if len(e.value) <= 4 {
+			b = append(b, e.value...)
+			b = append(b, make([]byte, 4-len(e.value))...)
+			continue
+		}
+		b = binary.LittleEndian.AppendUint32(b, uint32(valueOffset+len(values)))
+		values = append(values, e.value...)
+		if len(values)%2 == 1 {
+			values = append(values, 0)
+		}
+	}
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	return append(b, values...)
+}
+
+// testExif decodes a TIFF with the given EXIF and GPS tags, either of which
+// may be empty.
+func testExif(t *testing.T, exifTags, gpsTags []ifdEntry) *exif.Exif {
+	t.Helper()
+	b := []byte("II*\x00\x00\x00\x00\x00")
+	var ifd0 []ifdEntry
+	if len(exifTags) > 0 {
+		ifd0 = append(ifd0, longEntry(0x8769, len(b)))
+		b = appendIFD(b, exifTags)
+	}
+	if len(gpsTags) > 0 {
+		ifd0 = append(ifd0, longEntry(0x8825, len(b)))
+		b = appendIFD(b, gpsTags)
+	}
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)))
+	b = appendIFD(b, ifd0)
+
+	x, err := exif.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("exif.Decode: %v", err)
+	}
+	return x
+}
+
+func gpsTags(date string, hour, minute, second uint32) []ifdEntry {
+	return []ifdEntry{
+		rationalEntry(0x0007, [2]uint32{hour, 1}, [2]uint32{minute, 1}, [2]uint32{second, 1}),
+		asciiEntry(0x001D, date),
+	}
+}
+
+func TestCaptureTime(t *testing.T) {
+	saved := defaultZone
+	defaultZone = time.FixedZone("test", -3*3600)
+	t.Cleanup(func() { defaultZone = saved })
+
+	taken := asciiEntry(0x9003, "2023:06:01 12:00:00")
+	tests := []struct {
+		name       string
+		exifTags   []ifdEntry
+		gpsTags    []ifdEntry
+		wantOffset int
+		wantFrom   string
+	}{
+		{"offset", []ifdEntry{taken, asciiEntry(0x9011, "+05:30")}, nil, 5*3600 + 30*60, zoneFromOffset},
+		{"offset over gps", []ifdEntry{taken, asciiEntry(0x9011, "-04:00")}, gpsTags("2023:06:01", 11, 0, 0), -4 * 3600, zoneFromOffset},
+		{"gps", []ifdEntry{taken}, gpsTags("2023:06:01", 11, 0, 0), 3600, zoneFromGPS},
+		// A fix 1m40s old still gives a whole hour.
+		{"gps rounded to the hour", []ifdEntry{taken}, gpsTags("2023:06:01", 10, 58, 20), 3600, zoneFromGPS},
+		{"gps rounded to a quarter hour", []ifdEntry{taken}, gpsTags("2023:06:01", 6, 16, 0), 5*3600 + 45*60, zoneFromGPS},
+		{"gps across midnight", []ifdEntry{taken}, gpsTags("2023:05:31", 23, 0, 0), 13 * 3600, zoneFromGPS},
+		{"gps too far out", []ifdEntry{taken}, gpsTags("2023:05:01", 11, 0, 0), -3 * 3600, zoneFromDefault},
+		{"default", []ifdEntry{taken}, nil, -3 * 3600, zoneFromDefault},
+	}
+	for _, test := range tests {
+		got, from, err := captureTime(testExif(t, test.exifTags, test.gpsTags))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if from != test.wantFrom {
+			t.Errorf("%s: zone from %q, want %q", test.name, from, test.wantFrom)
+		}
+		if _, offset := got.Zone(); offset != test.wantOffset {
+			t.Errorf("%s: offset %v, want %v", test.name, time.Duration(offset)*time.Second, time.Duration(test.wantOffset)*time.Second)
+		}
+		if wall := got.Format(time.DateTime); wall != "2023-06-01 12:00:00" {
+			t.Errorf("%s: wall clock %s, want 2023-06-01 12:00:00", test.name, wall)
+		}
+	}
+}
+
+func TestCaptureTimeWithoutDate(t *testing.T) {
+	if got, _, err := captureTime(testExif(t, []ifdEntry{asciiEntry(0x9011, "+01:00")}, nil)); err == nil {
+		t.Errorf("got %v, want an error", got)
+	}
+}
+
+func TestGPSTime(t *testing.T) {
+	x := testExif(t, nil, []ifdEntry{
+		rationalEntry(0x0007, [2]uint32{14, 1}, [2]uint32{5, 1}, [2]uint32{1505, 100}),
+		asciiEntry(0x001D, "2023:06:01"),
+	})
+	got, ok := gpsTime(x)
+	want := time.Date(2023, 6, 1, 14, 5, 15, 50*int(time.Millisecond), time.UTC)
+	if !ok || !got.Equal(want) {
+		t.Errorf("gpsTime = %v, %t, want %v", got, ok, want)
+	}
+
+	for name, tags := range map[string][]ifdEntry{
+		"no date": {rationalEntry(0x0007, [2]uint32{14, 1}, [2]uint32{5, 1}, [2]uint32{0, 1})},
+		"no time": {asciiEntry(0x001D, "2023:06:01")},
+		"bad date": {
+			rationalEntry(0x0007, [2]uint32{14, 1}, [2]uint32{5, 1}, [2]uint32{0, 1}),
+			asciiEntry(0x001D, "    :  :  "),
+		},
+	} {
+		if got, ok := gpsTime(testExif(t, []ifdEntry{asciiEntry(0x9003, "2023:06:01 12:00:00")}, tags)); ok {
+			t.Errorf("%s: got %v, want nothing", name, got)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"chronoshot/pkg/db"
+)
+
+// dateRange selects assets taken between From (inclusive) and To (exclusive).
+// A zero bound is open.
+type dateRange struct {
+	From time.Time
+	To   time.Time
+}
+
+// parseDateRange accepts dates as YYYY-MM-DD, in defaultZone, or RFC 3339.
+// A date-only "to" includes the whole of that day.
+func parseDateRange(from, to string) (dateRange, error) {
+	var r dateRange
+	var err error
+	if from != "" {
+		if r.From, _, err = parseDate(from); err != nil {
+			return r, err
+		}
+	}
+	if to != "" {
+		var dateOnly bool
+		if r.To, dateOnly, err = parseDate(to); err != nil {
+			return r, err
+		}
+		if dateOnly {
+			r.To = r.To.AddDate(0, 0, 1)
+		}
+	}
+	return r, nil
+}
+
+func parseDate(s string) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, defaultZone); err == nil {
+		return t, true, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, false, nil
+	}
+	return time.Time{}, false, fmt.Errorf("invalid date %q, expected YYYY-MM-DD or RFC 3339", s)
+}
+
+// parseDateShift parses offsets such as "+1y -3h" or "2d 30min". Each is a
+// signed whole number followed by y, mo, w, d, h, min or s.
+func parseDateShift(s string) (db.DateShift, error) {
+	var shift db.DateShift
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return shift, fmt.Errorf("empty date shift")
+	}
+	for _, field := range fields {
+		i := strings.LastIndexAny(field, "0123456789") + 1
+		n, err := strconv.Atoi(field[:i])
+		if err != nil || i == 0 {
+			return shift, fmt.Errorf("invalid date shift %q, expected a number and unit such as +1y or -3h", field)
+		}
+		switch field[i:] {
+		case "y":
+			shift.Years += n
+		case "mo":
+			shift.Months += n
+		case "w":
+			shift.Days += 7 * n
+		case "d":
+			shift.Days += n
+		case "h":
+			shift.Duration += time.Duration(n) * time.Hour
+		case "min":
+			shift.Duration += time.Duration(n) * time.Minute
+		case "s":
+			shift.Duration += time.Duration(n) * time.Second
+		case "m":
+			return shift, fmt.Errorf("ambiguous date shift %q, use mo for months or min for minutes", field)
+		default:
+			return shift, fmt.Errorf("invalid date shift unit in %q, expected y, mo, w, d, h, min or s", field)
+		}
+	}
+	return shift, nil
+}
+
+func (r dateRange) Contains(t time.Time) bool {
+	if !r.From.IsZero() && t.Before(r.From) {
+		return false
+	}
+	if !r.To.IsZero() && !t.Before(r.To) {
+		return false
+	}
+	return true
+}
+
+// assetsInSet returns the assets in a set, as seen by user, that were taken
+// within r.
+func assetsInSet(user db.User, setName string, r dateRange) ([]db.Asset, error) {
+	if strings.HasPrefix(setName, "smart:") {
+		return search(user, setName, searchQuery{Dates: r})
+	}
+	bucket, err := db.ResolveSet(user.Name, setName)
+	if err != nil {
+		return nil, err
+	}
+	assets := db.GetAllAssetKeys(bucket)
+	if r.From.IsZero() && r.To.IsZero() {
+		return assets, nil
+	}
+
+	var inRange []db.Asset
+	for _, asset := range assets {
+		if r.Contains(asset.DateTime) {
+			inRange = append(inRange, asset)
+		}
+	}
+	return inRange, nil
+}
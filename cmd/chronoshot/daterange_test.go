@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"chronoshot/pkg/db"
+)
+
+func TestParseDateShift(t *testing.T) {
+	tests := []struct {
+		in   string
+		want db.DateShift
+	}{
+		{"+1y -3h", db.DateShift{Years: 1, Duration: -3 * time.Hour}},
+		{"1y", db.DateShift{Years: 1}},
+		{"-2mo", db.DateShift{Months: -2}},
+		{"+2w -1d", db.DateShift{Days: 13}},
+		{"30min", db.DateShift{Duration: 30 * time.Minute}},
+		{"-90s", db.DateShift{Duration: -90 * time.Second}},
+		{"1mo 1min", db.DateShift{Months: 1, Duration: time.Minute}},
+		{"  +1d   +1d ", db.DateShift{Days: 2}},
+	}
+	for _, test := range tests {
+		got, err := parseDateShift(test.in)
+		if err != nil {
+			t.Errorf("parseDateShift(%q): %v", test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseDateShift(%q) = %+v, want %+v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseDateShiftErrors(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"   ",
+		"5m",  // months or minutes
+		"-1m", // likewise
+		"h",
+		"1.5h",
+		"+-1d",
+		"1 d",
+		"1x",
+		"1y nonsense",
+	} {
+		if got, err := parseDateShift(in); err == nil {
+			t.Errorf("parseDateShift(%q) = %+v, want an error", in, got)
+		}
+	}
+}
+
+func TestParseDateRangeInDefaultZone(t *testing.T) {
+	saved := defaultZone
+	defaultZone = time.FixedZone("test", 10*3600)
+	t.Cleanup(func() { defaultZone = saved })
+
+	r, err := parseDateRange("2023-06-01", "2023-06-01T12:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2023, 5, 31, 14, 0, 0, 0, time.UTC); !r.From.Equal(want) {
+		t.Errorf("From = %v, want %v", r.From, want)
+	}
+	if want := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC); !r.To.Equal(want) {
+		t.Errorf("To = %v, want %v", r.To, want)
+	}
+
+	r, err = parseDateRange("", "2023-06-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2023, 6, 1, 14, 0, 0, 0, time.UTC); !r.To.Equal(want) {
+		t.Errorf("date-only To = %v, want %v", r.To, want)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"container/list"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// diskCache stores generated files in a directory, evicting the least recently
+// used entries once the total size exceeds maxBytes. Concurrent requests for
+// the same entry share a single call to the fill function.
+type diskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	size     int64
+	lru      *list.List // front is most recently used
+	entries  map[string]*list.Element
+	inflight map[string]*cacheCall
+}
+
+type cacheEntry struct {
+	name string
+	size int64
+}
+
+type cacheCall struct {
+	wg  sync.WaitGroup
+	buf []byte
+	err error
+}
+
+func newDiskCache(dir string, maxBytes int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	c := &diskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		inflight: make(map[string]*cacheCall),
+	}
+
+	// Rebuild the LRU from a previous run, using modification time as a
+	// stand-in for last access (hits touch the file).
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) == ".tmp" {
+			continue
+		}
+		c.entries[f.Name()] = c.lru.PushFront(&cacheEntry{f.Name(), f.Size()})
+		c.size += f.Size()
+	}
+
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+
+	return c, nil
+}
+
+// Get returns the cached contents of name, calling fill to produce and store
+// them on a miss.
+func (c *diskCache) Get(name string, fill func() ([]byte, error)) ([]byte, error) {
+	if buf, ok := c.load(name); ok {
+		return buf, nil
+	}
+
+	c.mu.Lock()
+	if call, ok := c.inflight[name]; ok {
+		c.mu.Unlock()
+		call.wg.Wait()
+		return call.buf, call.err
+	}
+	call := new(cacheCall)
+	call.wg.Add(1)
+	c.inflight[name] = call
+	c.mu.Unlock()
+
+	call.buf, call.err = fill()
+	if call.err == nil {
+		c.store(name, call.buf)
+	}
+
+	c.mu.Lock()
+	delete(c.inflight, name)
+	c.mu.Unlock()
+	call.wg.Done()
+
+	return call.buf, call.err
+}
+
+func (c *diskCache) load(name string) ([]byte, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[name]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	p := filepath.Join(c.dir, name)
+	buf, err := ioutil.ReadFile(p)
+	if err != nil {
+		// Removed from under us, forget it and regenerate.
+		c.mu.Lock()
+		if e, ok := c.entries[name]; ok {
+			c.remove(e)
+		}
+		c.mu.Unlock()
+		return nil, false
+	}
+
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return buf, true
+}
+
+func (c *diskCache) store(name string, buf []byte) {
+	p := filepath.Join(c.dir, name)
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		slog.Error("Could not write cache file", "path", tmp, "err", err)
+		return
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		slog.Error("Could not write cache file", "path", p, "err", err)
+		os.Remove(tmp)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[name]; ok {
+		c.size -= e.Value.(*cacheEntry).size
+		c.lru.Remove(e)
+	}
+	c.entries[name] = c.lru.PushFront(&cacheEntry{name, int64(len(buf))})
+	c.size += int64(len(buf))
+	c.evict()
+}
+
+// evict must be called with c.mu held.
+func (c *diskCache) evict() {
+	for c.size > c.maxBytes && c.lru.Len() > 0 {
+		e := c.lru.Back()
+		if err := os.Remove(filepath.Join(c.dir, e.Value.(*cacheEntry).name)); err != nil && !os.IsNotExist(err) {
+			slog.Warn("Could not evict cache file", "err", err)
+		}
+		c.remove(e)
+	}
+}
+
+// remove must be called with c.mu held.
+func (c *diskCache) remove(e *list.Element) {
+	entry := e.Value.(*cacheEntry)
+	c.lru.Remove(e)
+	delete(c.entries, entry.name)
+	c.size -= entry.size
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"chronoshot/pkg/db"
+)
+
+// exportRequest describes copying the originals of a set out of chronoshot,
+// either into a directory or into a tar file.
+type exportRequest struct {
+	Set      string
+	From     string
+	To       string
+	Target   string // absolute path of the directory or tar file
+	Format   string // dir (default) or tar
+	Hardlink bool   // link rather than copy, dir exports only
+	Template string // naming template, see archiveNamer
+}
+
+// startExport runs an export in the background, writing captions and tags as
+// XMP sidecars next to the originals. Exports are resumable: a
+// repeated directory export skips files that are already present, and an
+// interrupted tar export carries on from the last complete entry.
+func startExport(user db.User, req exportRequest) (*job, error) {
+	if req.Set == "" {
+		req.Set = "all"
+	}
+	dates, err := parseDateRange(req.From, req.To)
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(req.Target) {
+		return nil, errors.New("export target must be an absolute path")
+	}
+	if req.Template == "" {
+		req.Template = datedTemplate
+	}
+	namer, err := newArchiveNamer(req.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	var export func(*job, []db.Asset, *archiveNamer) error
+	switch req.Format {
+	case "", "dir":
+		export = func(j *job, assets []db.Asset, namer *archiveNamer) error {
+			return exportToDirectory(j, assets, namer, req.Target, req.Hardlink)
+		}
+	case "tar":
+		if req.Hardlink {
+			return nil, errors.New("hardlinks are only supported for directory exports")
+		}
+		export = func(j *job, assets []db.Asset, namer *archiveNamer) error {
+			return exportToTar(j, assets, namer, req.Target)
+		}
+	default:
+		return nil, fmt.Errorf("invalid export format %q", req.Format)
+	}
+
+	assets, err := assetsInSet(user, req.Set, dates)
+	if err != nil {
+		return nil, err
+	}
+	j, err := newJob("export")
+	if err != nil {
+		return nil, err
+	}
+	j.SetTotal(len(assets))
+	go func() {
+		j.Finish(export(j, assets, namer))
+	}()
+	return j, nil
+}
+
+func exportToDirectory(j *job, assets []db.Asset, namer *archiveNamer, dir string, hardlink bool) error {
+	for _, asset := range assets {
+		if isStopping() {
+			return errStopped
+		}
+		src := string(db.GetAssetPath([]byte(asset.AssetKey)))
+		name := namer.Name(src, asset.DateTime)
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+
+		exported, err := exportFile(src, dst, hardlink)
+		if err == nil {
+			err = exportSidecar(asset.AssetKey, filepath.Join(dir, filepath.FromSlash(sidecarName(name))))
+		}
+		if err != nil {
+			j.Fail(src, err)
+		} else if exported {
+			j.Succeed()
+		} else {
+			j.Skip()
+		}
+	}
+	return nil
+}
+
+// exportFile copies or links src to dst, reporting false if dst is already
+// an up to date copy.
+func exportFile(src string, dst string, hardlink bool) (bool, error) {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return false, err
+	}
+	if dstInfo, err := os.Stat(dst); err == nil {
+		if os.SameFile(srcInfo, dstInfo) ||
+			(dstInfo.Size() == srcInfo.Size() && dstInfo.ModTime().Unix() == srcInfo.ModTime().Unix()) {
+			return false, nil
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return false, err
+	}
+
+	if hardlink {
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		return true, os.Link(src, dst)
+	}
+
+	// Copy to a temporary name first so that an interrupted export never
+	// leaves a truncated file that looks complete.
+	in, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	part := dst + ".part"
+	out, err := os.Create(part)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(part)
+		return false, err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(part)
+		return false, err
+	}
+	if err := os.Chtimes(part, srcInfo.ModTime(), srcInfo.ModTime()); err != nil {
+		os.Remove(part)
+		return false, err
+	}
+	return true, os.Rename(part, dst)
+}
+
+// exportSidecar writes the asset's caption and tags to dst, or removes a
+// sidecar left by an earlier export if they have since been cleared.
+func exportSidecar(keyHash string, dst string) error {
+	sidecar := assetSidecar(keyHash)
+	if sidecar == nil {
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if existing, err := os.ReadFile(dst); err == nil && bytes.Equal(existing, sidecar) {
+		return nil
+	}
+	return os.WriteFile(dst, sidecar, 0644)
+}
+
+// countingWriter tracks the offset reached in a tar file, so that the end of
+// each complete entry can be recorded.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// exportToTar writes the assets to a tar file. While the export runs, the end
+// offset, asset key and name of each complete entry is appended to a
+// ".progress" file next to the target; if that file exists at the start, the
+// tar is truncated to the last complete entry and the export carries on from
+// there. Assets already written are skipped by key and keep their names, so
+// that assets added to the set or redated in between are named around them.
+func exportToTar(j *job, assets []db.Asset, namer *archiveNamer, target string) error {
+	progressPath := target + ".progress"
+	done, offset, err := readExportProgress(progressPath)
+	if err != nil {
+		return err
+	}
+	if done == nil {
+		if _, err := os.Stat(target); err == nil {
+			return fmt.Errorf("%s already exists", target)
+		}
+		done = make(map[string]string)
+	}
+	for _, name := range done {
+		namer.Keep(name)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	progress, err := os.OpenFile(progressPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer progress.Close()
+
+	counter := &countingWriter{f, offset}
+	tarWriter := tar.NewWriter(counter)
+	for _, asset := range assets {
+		if isStopping() {
+			return errStopped
+		}
+		if _, ok := done[asset.AssetKey]; ok {
+			j.Skip()
+			continue
+		}
+		src := string(db.GetAssetPath([]byte(asset.AssetKey)))
+		name := namer.Name(src, asset.DateTime)
+
+		file, err := os.Open(src)
+		if err != nil {
+			j.Fail(src, err)
+			continue
+		}
+		err = addFileToTar(tarWriter, file, name)
+		file.Close()
+		if sidecar := assetSidecar(asset.AssetKey); err == nil && sidecar != nil {
+			err = addSidecarToTar(tarWriter, sidecar, sidecarName(name))
+		}
+		if err != nil {
+			// The tar may now hold a partial entry, so stop here and let a
+			// later run resume from the last complete one.
+			return fmt.Errorf("writing %s: %v", src, err)
+		}
+		if _, err := fmt.Fprintf(progress, "%d\t%s\t%s\n", counter.n, strconv.Quote(asset.AssetKey), strconv.Quote(name)); err != nil {
+			return err
+		}
+		j.Succeed()
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	progress.Close()
+	return os.Remove(progressPath)
+}
+
+func addFileToTar(tarWriter *tar.Writer, file *os.File, name string) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tarWriter, file); err != nil {
+		return err
+	}
+	return tarWriter.Flush()
+}
+
+func addSidecarToTar(tarWriter *tar.Writer, sidecar []byte, name string) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(sidecar)),
+		ModTime: time.Now(),
+	}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := tarWriter.Write(sidecar); err != nil {
+		return err
+	}
+	return tarWriter.Flush()
+}
+
+// readExportProgress returns the entry names recorded by an interrupted tar
+// export, by asset key, and the offset at which to continue, or a nil map if
+// there is none.
+func readExportProgress(path string) (map[string]string, int64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	done := make(map[string]string)
+	var offset int64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 3)
+		if len(fields) != 3 {
+			// Torn final line from an interrupted write.
+			break
+		}
+		n, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			break
+		}
+		key, err := strconv.Unquote(fields[1])
+		if err != nil {
+			break
+		}
+		name, err := strconv.Unquote(fields[2])
+		if err != nil {
+			break
+		}
+		done[key] = name
+		offset = n
+	}
+	return done, offset, scanner.Err()
+}
+
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	var req exportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	j, err := startExport(currentUser(r), req)
+	if err != nil {
+		http.Error(w, err.Error(), jobErrorStatus(err))
+		return
+	}
+	writeJSON(w, http.StatusAccepted, j.Progress())
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"chronoshot/pkg/db"
+	"chronoshot/pkg/db/dbtest"
+)
+
+// tarEntries returns the names and contents of the entries in the tar file.
+func tarEntries(t *testing.T, path string) ([]string, map[string]string) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var names []string
+	contents := make(map[string]string)
+	r := tar.NewReader(f)
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return names, contents
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+		contents[header.Name] = string(b)
+	}
+}
+
+func TestExportToTarResumesAfterSetChanges(t *testing.T) {
+	dbtest.Open(t)
+	photos := t.TempDir()
+	taken := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	asset := func(path string, dateTime time.Time) db.Asset {
+		path = filepath.Join(photos, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return db.Asset{AssetKey: string(dbtest.PutAsset(path, dateTime, db.AssetMeta{})), DateTime: dateTime}
+	}
+	first := asset("a/IMG_1.jpg", taken)
+	// A directory cannot be written to the tar, which interrupts the export
+	// as a full disk would.
+	broken := asset("b/IMG_2.jpg", taken)
+	if err := os.Remove(filepath.Join(photos, "b/IMG_2.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(photos, "b/IMG_2.jpg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(t.TempDir(), "export.tar")
+	namer, _ := newArchiveNamer(datedTemplate)
+	if err := exportToTar(&job{}, []db.Asset{first, broken}, namer, target); err == nil {
+		t.Fatal("no error for an entry that could not be written")
+	}
+
+	// A photo with the same name is added ahead of the one already written.
+	added := asset("c/IMG_1.jpg", taken.Add(-time.Hour))
+	j := &job{}
+	namer, _ = newArchiveNamer(datedTemplate)
+	if err := exportToTar(j, []db.Asset{added, first}, namer, target); err != nil {
+		t.Fatal(err)
+	}
+	if p := j.Progress(); p.Done != 2 || p.Skipped != 1 {
+		t.Errorf("progress %+v, want 2 done, 1 of them skipped", p)
+	}
+	names, contents := tarEntries(t, target)
+	if want := []string{"2023/06/IMG_1.jpg", "2023/06/IMG_1_1.jpg"}; !slices.Equal(names, want) {
+		t.Fatalf("entries %q, want %q", names, want)
+	}
+	if got := contents["2023/06/IMG_1.jpg"]; got != filepath.Join(photos, "a/IMG_1.jpg") {
+		t.Errorf("2023/06/IMG_1.jpg holds %s", got)
+	}
+	if got := contents["2023/06/IMG_1_1.jpg"]; got != filepath.Join(photos, "c/IMG_1.jpg") {
+		t.Errorf("2023/06/IMG_1_1.jpg holds %s", got)
+	}
+	if exists(target + ".progress") {
+		t.Error("progress file left after the export finished")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"chronoshot/pkg/db"
+)
+
+// Set once the initial walk of the photo directory has finished, and while
+// new photos are being watched for.
+var initialIndexDone atomic.Bool
+var watching atomic.Bool
+
+type healthStatus struct {
+	Status   string // ok, ready, or the reason for not being
+	Database string
+	Indexed  bool `json:",omitempty"`
+	Watching bool `json:",omitempty"`
+	Stopping bool `json:",omitempty"`
+}
+
+func databaseStatus() string {
+	if err := db.Ping(); err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+// healthzHandler reports whether the process is up and the database usable.
+// Restarting chronoshot is the fix if not.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	status := healthStatus{Status: "ok", Database: databaseStatus()}
+	if status.Database != "ok" {
+		status.Status = "database unavailable"
+		writeJSON(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// readyzHandler reports whether chronoshot has finished its initial index
+// and is watching for new photos, so that it serves a complete library.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	status := healthStatus{
+		Status:   "ready",
+		Database: databaseStatus(),
+		Indexed:  initialIndexDone.Load(),
+		Watching: watching.Load(),
+		Stopping: isStopping(),
+	}
+	switch {
+	case status.Stopping:
+		status.Status = "shutting down"
+	case status.Database != "ok":
+		status.Status = "database unavailable"
+	case !status.Indexed:
+		status.Status = "indexing"
+	case !status.Watching:
+		status.Status = "not watching"
+	}
+	if status.Status != "ready" {
+		writeJSON(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
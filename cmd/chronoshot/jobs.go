@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Number of per-item errors kept on a job, beyond which only the count grows.
+const maxJobErrors = 100
+
+// jobProgress is a snapshot of a background job, as reported over HTTP.
+type jobProgress struct {
+	ID       string
+	Kind     string
+	Status   string // running, finished or failed
+	Total    int
+	Done     int
+	Skipped  int
+	Failed   int
+	Errors   []string
+	Started  time.Time
+	Finished time.Time
+}
+
+// job tracks a long running operation over a number of items.
+type job struct {
+	mu       sync.Mutex
+	progress jobProgress
+}
+
+// runningJobs lets shutdown wait for jobs, which stop early once it begins.
+var runningJobs tracker
+
+var jobs = struct {
+	sync.Mutex
+	m map[string]*job
+}{m: make(map[string]*job)}
+
+// newJob starts tracking a job, or returns errStopped once shutdown has
+// begun.
+func newJob(kind string) (*job, error) {
+	if isStopping() || !runningJobs.Add() {
+		return nil, errStopped
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	j := &job{progress: jobProgress{
+		ID:      hex.EncodeToString(b),
+		Kind:    kind,
+		Status:  "running",
+		Started: time.Now(),
+	}}
+
+	jobs.Lock()
+	jobs.m[j.progress.ID] = j
+	jobs.Unlock()
+	return j, nil
+}
+
+// jobErrorStatus is the status for an error starting a job, which is the
+// request's fault unless the server is shutting down.
+func jobErrorStatus(err error) int {
+	if err == errStopped {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
+func getJob(id string) (*job, bool) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	j, ok := jobs.m[id]
+	return j, ok
+}
+
+func listJobs() []jobProgress {
+	jobs.Lock()
+	list := make([]jobProgress, 0, len(jobs.m))
+	for _, j := range jobs.m {
+		list = append(list, j.Progress())
+	}
+	jobs.Unlock()
+
+	sort.Slice(list, func(i, k int) bool { return list[i].Started.After(list[k].Started) })
+	return list
+}
+
+func (j *job) Progress() jobProgress {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	p := j.progress
+	p.Errors = append([]string(nil), p.Errors...)
+	return p
+}
+
+func (j *job) SetTotal(total int) {
+	j.mu.Lock()
+	j.progress.Total = total
+	j.mu.Unlock()
+}
+
+func (j *job) Succeed() {
+	j.mu.Lock()
+	j.progress.Done++
+	j.mu.Unlock()
+}
+
+// Skip records an item that needed no work, e.g. already exported.
+func (j *job) Skip() {
+	j.mu.Lock()
+	j.progress.Done++
+	j.progress.Skipped++
+	j.mu.Unlock()
+}
+
+func (j *job) Fail(item string, err error) {
+	j.mu.Lock()
+	j.progress.Done++
+	j.progress.Failed++
+	if len(j.progress.Errors) < maxJobErrors {
+		j.progress.Errors = append(j.progress.Errors, item+": "+err.Error())
+	}
+	j.mu.Unlock()
+}
+
+// Finish marks the job as complete. A non-nil err means the job as a whole
+// failed, rather than some of its items.
+func (j *job) Finish(err error) {
+	j.mu.Lock()
+	j.progress.Status = "finished"
+	if err != nil {
+		j.progress.Status = "failed"
+		j.progress.Errors = append(j.progress.Errors, err.Error())
+	}
+	j.progress.Finished = time.Now()
+	j.mu.Unlock()
+	runningJobs.Done()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	w.WriteHeader(status)
+	if _, err := w.Write(buf); err != nil {
+		slog.Debug("Unable to write response", "err", err)
+	}
+}
+
+func getJobsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, listJobs())
+}
+
+func getJobHandler(w http.ResponseWriter, r *http.Request) {
+	j, ok := getJob(r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, j.Progress())
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logLevel = flag.String("log-level", "info", "minimum level logged: debug, info, warn or error")
+var logFormat = flag.String("log-format", "text", "log format: text or json")
+var logFile = flag.String("log-file", "", "file to log to instead of stderr")
+var logMaxSize = flag.Int64("log-max-size", 100, "size in MB at which -log-file is rotated")
+var logMaxBackups = flag.Int("log-max-backups", 5, "number of rotated log files kept")
+
+// setupLogging makes slog, and the log package through it, write as the
+// flags ask.
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return fmt.Errorf("invalid -log-level %q", *logLevel)
+	}
+
+	var w io.Writer = os.Stderr
+	if *logFile != "" {
+		f, err := newRotatingFile(*logFile, *logMaxSize<<20, *logMaxBackups)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch *logFormat {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid -log-format %q", *logFormat)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// rotatingFile is a log file that is renamed to name.1, name.2 and so on
+// when it reaches maxBytes, keeping at most maxBackups old files.
+type rotatingFile struct {
+	name       string
+	maxBytes   int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func newRotatingFile(name string, maxBytes int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{name: name, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+// rotate reopens name even if renaming the old files fails, in which case
+// the file carries on growing rather than messages being lost.
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	os.Remove(fmt.Sprintf("%s.%d", r.name, r.maxBackups))
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.name, i), fmt.Sprintf("%s.%d", r.name, i+1))
+	}
+	var err error
+	if r.maxBackups > 0 {
+		err = os.Rename(r.name, r.name+".1")
+	} else {
+		err = os.Remove(r.name)
+	}
+	if openErr := r.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to rotate log file:", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// requestInfo identifies a request in log messages.
+type requestInfo struct {
+	ID   string
+	User string // set by requireAuth once known
+}
+
+const requestInfoContextKey contextKey = 1
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// isValidRequestID accepts IDs from a proxy in front of chronoshot, as long
+// as they are safe to log.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// setRequestUser records who made a request, for its log messages.
+func setRequestUser(r *http.Request, userName string) {
+	if info, ok := r.Context().Value(requestInfoContextKey).(*requestInfo); ok {
+		info.User = userName
+	}
+}
+
+// requestLogger returns a logger that tags messages with the request's ID
+// and user.
+func requestLogger(r *http.Request) *slog.Logger {
+	info, ok := r.Context().Value(requestInfoContextKey).(*requestInfo)
+	if !ok {
+		return slog.Default()
+	}
+	if info.User != "" {
+		return slog.With("request_id", info.ID, "user", info.User)
+	}
+	return slog.With("request_id", info.ID)
+}
+
+// loggedPath hides share link tokens, which grant access to anyone who
+// reads them.
+func loggedPath(path string) string {
+	if rest, ok := strings.CutPrefix(path, "/s/"); ok {
+		if _, after, ok := strings.Cut(rest, "/"); ok {
+			return "/s/-/" + after
+		}
+		return "/s/-"
+	}
+	return path
+}
+
+// withRequestLogging gives each request an ID, returned in X-Request-ID, and
+// logs it once served.
+func withRequestLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !isValidRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		info := &requestInfo{ID: id}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoContextKey, info))
+		recorder := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		if recorder.status >= 500 {
+			level = slog.LevelError
+		}
+		requestLogger(r).Log(r.Context(), level, "request",
+			"method", r.Method,
+			"path", loggedPath(r.URL.Path),
+			"status", recorder.status,
+			"bytes", recorder.bytes,
+			"duration", time.Since(start),
+			"remote", r.RemoteAddr,
+		)
+	})
+}
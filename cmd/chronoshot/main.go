@@ -1,15 +1,17 @@
 package main
 
 import (
-	"archive/zip"
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"image"
 	"image/jpeg"
-	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path"
@@ -18,8 +20,9 @@ import (
 	"strings"
 	"time"
 
+	"chronoshot/pkg/db"
+
 	"github.com/disintegration/imaging"
-	"github.com/vjdw/chronoshot/pkg/db"
 
 	"github.com/rjeczalik/notify"
 
@@ -53,79 +56,17 @@ func getAssetCountHandler(w http.ResponseWriter, r *http.Request) {
 	response := strconv.Itoa(db.GetLengthOfIndex())
 	w.Header().Set("Content-Length", strconv.Itoa(len(response)))
 	if _, err := w.Write([]byte(response)); err != nil {
-		log.Println("unable to write response.")
-	}
-}
-
-// xyzzy move to file
-// type asset struct {
-// 	AssetKey string
-// }
-
-func getAssetInfosHandler(w http.ResponseWriter, r *http.Request) {
-	setName := r.URL.Query().Get("set")
-	if setName == "" {
-		setName = "all"
-	}
-	assetsInSet := db.GetAllAssetKeys([]byte(setName))
-
-	buf, err := json.Marshal(assetsInSet)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
-	if _, err := w.Write(buf); err != nil {
-		log.Println("unable to write response.")
+		requestLogger(r).Debug("Unable to write response", "err", err)
 	}
 }
 
-func getSetArchiveHandler(w http.ResponseWriter, r *http.Request) {
-	setName := r.URL.Query().Get("set")
-	if setName == "" {
-		setName = "all"
-	}
-	assetsInSet := db.GetAllAssetKeys([]byte(setName))
-
-	w.Header().Set("Content-Type", "application/zip")
-	zipWriter := zip.NewWriter(w)
-	defer zipWriter.Close()
-	for _, assetKey := range assetsInSet {
-		assetPath := db.GetAssetPath([]byte(assetKey.AssetKey))
-
-		file, err := os.Open(string(assetPath))
-		check(err)
-		defer file.Close()
-
-		info, err := file.Stat()
-		check(err)
-		header, err := zip.FileInfoHeader(info)
-		check(err)
-		header.Method = zip.Deflate
-		headerWriter, err := zipWriter.CreateHeader(header)
-		check(err)
-		_, err = io.Copy(headerWriter, file)
-		check(err)
-	}
-	zipWriter.Close()
-}
-
-func getAssetHandler(w http.ResponseWriter, r *http.Request) {
-	key := r.URL.Query().Get("id")
-
-	if !db.KeyExists([]byte(key)) {
-		log.Println("Key does not exist ", string(key))
-		http.NotFound(w, r)
-		return
-	}
-
+func serveAsset(w http.ResponseWriter, r *http.Request, key string) {
 	imgPath := db.GetAssetPath([]byte(key))
-	log.Println("Requested asset:", string(imgPath))
+	requestLogger(r).Debug("Serving asset", "path", string(imgPath))
 
 	f, err := os.Open(string(imgPath[:]))
 	if err != nil {
-		log.Println("Could not open file", string(imgPath[:]))
+		requestLogger(r).Warn("Could not open asset", "path", string(imgPath), "err", err)
 		http.NotFound(w, r)
 		return
 	}
@@ -133,7 +74,7 @@ func getAssetHandler(w http.ResponseWriter, r *http.Request) {
 	var buf bytes.Buffer
 	_, err = buf.ReadFrom(f)
 	if err != nil {
-		log.Println("Could not read file", string(imgPath[:]))
+		requestLogger(r).Warn("Could not read asset", "path", string(imgPath), "err", err)
 		http.NotFound(w, r)
 		return
 	}
@@ -141,37 +82,26 @@ func getAssetHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "image/jpeg")
 	w.Header().Set("Content-Length", strconv.Itoa(len(buf.Bytes())))
 	if _, err := w.Write(buf.Bytes()); err != nil {
-		log.Println("unable to write image.")
+		requestLogger(r).Debug("Unable to write image", "err", err)
 	}
 }
 
-func getThumbnailHandler(w http.ResponseWriter, r *http.Request) {
-	key := r.URL.Query().Get("id")
-
-	if !db.KeyExists([]byte(key)) {
-		log.Println("Key does not exist ", string(key))
-		http.NotFound(w, r)
-		return
+func serveThumbnail(w http.ResponseWriter, r *http.Request, key string) {
+	size, err := strconv.Atoi(r.URL.Query().Get("size"))
+	if err != nil || size <= 0 {
+		size = defaultThumbnailSize
 	}
 
-	buf := db.GetThumbnail([]byte(key))
+	buf := db.GetThumbnail([]byte(key), size)
 
 	w.Header().Set("Content-Type", "image/jpeg")
 	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
 	if _, err := w.Write(buf); err != nil {
-		log.Println("unable to write image.")
+		requestLogger(r).Debug("Unable to write image", "err", err)
 	}
 }
 
-func getExifDateTimeHandler(w http.ResponseWriter, r *http.Request) {
-	key := r.URL.Query().Get("id")
-
-	if !db.KeyExists([]byte(key)) {
-		log.Println("Key does not exist ", string(key))
-		http.NotFound(w, r)
-		return
-	}
-
+func getExifDateTimeHandler(w http.ResponseWriter, r *http.Request, key string) {
 	dateTime := db.GetDateTime([]byte(key))
 	buf, err := json.Marshal(map[string]time.Time{"datetime": dateTime})
 	if err != nil {
@@ -181,47 +111,30 @@ func getExifDateTimeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
 	if _, err := w.Write(buf); err != nil {
-		log.Println("unable to write response.")
+		requestLogger(r).Debug("Unable to write response", "err", err)
 	}
 }
 
-// xyzzy move to file
-type selection struct {
-	AssetKey   string
-	IsSelected bool
-}
-
-func selectHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "GET" {
-		key := r.URL.Query().Get("id")
+// The original routes for favourites and ratings reply with the value on
+// GET, and take the asset in the body on POST, which then goes to the v1
+// handler. See withBodyAssetKey.
 
-		if !db.KeyExists([]byte(key)) {
-			log.Println("Key does not exist ", string(key))
-			http.NotFound(w, r)
-			return
-		}
+func getSelectionHandler(w http.ResponseWriter, r *http.Request, key string) {
+	writeJSON(w, http.StatusOK, map[string]bool{"isSelected": db.GetIsSelected(currentUser(r).Name, []byte(key))})
+}
 
-		isSelected := db.GetIsSelected([]byte(key))
-		buf, err := json.Marshal(map[string]bool{"isSelected": isSelected})
-		if err != nil {
-			log.Fatal(err)
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
-		if _, err := w.Write(buf); err != nil {
-			log.Println("unable to write response.")
-		}
-	}
-	if r.Method == "POST" {
-		decoder := json.NewDecoder(r.Body)
-		var s selection
-		err := decoder.Decode(&s)
-		if err != nil {
-			panic(err)
-		}
-		defer r.Body.Close()
-		db.PutSelection([]byte(s.AssetKey), s.IsSelected)
+func selectHandler(w http.ResponseWriter, r *http.Request, key string) {
+	var req struct{ IsSelected bool }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	defer r.Body.Close()
+	setFavourite(w, r, key, req.IsSelected)
+}
+
+func getRatingHandler(w http.ResponseWriter, r *http.Request, key string) {
+	writeJSON(w, http.StatusOK, map[string]int{"rating": db.GetRating(currentUser(r).Name, []byte(key))})
 }
 
 func watchDirectory(path string) {
@@ -238,12 +151,24 @@ func watchDirectory(path string) {
 		log.Fatal(err)
 	}
 	defer notify.Stop(c)
+	watching.Store(true)
+	defer watching.Store(false)
 
-	// Block until an event is received.
+	// Block until an event is received, or shutdown begins.
 	for {
-		ei := <-c
-		log.Println("Got event:", ei)
-		go processPhoto(ei.Path(), nil, nil)
+		select {
+		case ei := <-c:
+			slog.Debug("File changed", "event", ei.Event().String(), "path", ei.Path())
+			if strings.EqualFold(filepath.Ext(ei.Path()), ".xmp") {
+				path := ei.Path()
+				background.Go(func() { processSidecar(path) })
+				continue
+			}
+			path := ei.Path()
+			background.Go(func() { processPhoto(path, nil, nil) })
+		case <-stopping:
+			return
+		}
 	}
 }
 
@@ -252,7 +177,16 @@ var rateLimiter = make(chan bool, concurrency)
 
 func processPhoto(path string, info os.FileInfo, err error) error {
 	if err != nil {
-		log.Print(err)
+		slog.Warn("Could not walk", "path", path, "err", err)
+		return nil
+	}
+	if isStopping() {
+		return filepath.SkipAll
+	}
+	if inTrashDir(path) {
+		if info != nil && info.IsDir() {
+			return filepath.SkipDir
+		}
 		return nil
 	}
 
@@ -261,32 +195,58 @@ func processPhoto(path string, info os.FileInfo, err error) error {
 		defer func() { <-rateLimiter }()
 		lowerPath := strings.ToLower(path)
 		if strings.HasSuffix(lowerPath, ".jpg") || strings.HasSuffix(lowerPath, ".jpeg") {
-
-			if db.FilePathAdded([]byte(path)) {
-				fmt.Printf("Already in database: %s\n", path)
-				return
-			}
-
-			buf, err := ioutil.ReadFile(path)
-			check(err)
-			if len(buf) == 0 {
-				//fmt.Println("Could not process photo:", path, "because file is empty.")
-				chanLog <- strings.Join([]string{"Could not process photo:", path, "because file is empty."}, "")
-				return
-			}
-
-			datetime, orientation := getExifDateTime(buf)
-			err = storeThumbnail(path, buf, orientation, datetime)
-			if err != nil {
-				//fmt.Println("Could not process photo:", path, "because:", err)
-				chanLog <- strings.Join([]string{"Could not process photo:", path, "because:", err.Error()}, "")
-			}
+			indexPhoto(path)
 		}
 	}(path)
 
 	return nil
 }
 
+// indexPhoto adds the JPEG at path to the database and returns its key, or
+// nil if it was skipped because it is already there or was purged.
+func indexPhoto(path string) ([]byte, error) {
+	logger := slog.With("path", path)
+	filesSeen.Inc()
+
+	if db.FilePathAdded([]byte(path)) {
+		logger.Debug("Already in database")
+		filesSkipped.Inc()
+		return nil, nil
+	}
+	if fi, err := os.Stat(path); err == nil && db.IsFilePurged([]byte(path), fi.ModTime()) {
+		logger.Debug("Purged from the trash")
+		filesSkipped.Inc()
+		return nil, nil
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		logger.Error("Could not process photo", "err", err)
+		filesFailed.Inc()
+		return nil, err
+	}
+	if len(buf) == 0 {
+		logger.Error("Could not process photo because file is empty")
+		filesFailed.Inc()
+		return nil, errors.New("file is empty")
+	}
+
+	datetime, orientation := getExifDateTime(buf)
+	logger = logger.With("datetime", datetime)
+	start := time.Now()
+	meta := readMeta(path, buf)
+	key, err := storeThumbnail(path, buf, orientation, datetime, meta)
+	if err != nil {
+		logger.Error("Could not process photo", "err", err)
+		filesFailed.Inc()
+		return nil, err
+	}
+	applySidecarUser(key, db.AssetMeta{}, meta)
+	logger.Info("Indexed photo", "duration", time.Since(start))
+	filesIndexed.Inc()
+	return key, nil
+}
+
 func getExifDateTime(b []byte) (time.Time, *tiff.Tag) {
 	// f, err := os.Open(path)
 	// if err != nil {
@@ -315,9 +275,7 @@ func getExifDateTime(b []byte) (time.Time, *tiff.Tag) {
 	//numer, denom, _ := focal.Rat2(0) // retrieve first (only) rat. value
 	//fmt.Printf("%v/%v", numer, denom)
 
-	// Two convenience functions exist for date/time taken and GPS coords:
-	tm, _ := x.DateTime()
-	//fmt.Println("Taken: ", tm)
+	tm, _, _ := captureTime(x)
 
 	//lat, long, _ := x.LatLong()
 	//fmt.Println("lat, long: ", lat, ", ", long)
@@ -325,37 +283,23 @@ func getExifDateTime(b []byte) (time.Time, *tiff.Tag) {
 	return tm, orientation
 }
 
-func storeThumbnail(path string, b []byte, orientation *tiff.Tag, dateTime time.Time) error {
-	fmt.Println("storeThumbnail for", path)
-
+func storeThumbnail(path string, b []byte, orientation *tiff.Tag, dateTime time.Time, meta db.AssetMeta) ([]byte, error) {
 	r := bytes.NewReader(b)
 
 	// decode jpeg into image.Image
 	img, err := jpeg.Decode(r)
 	if err != nil {
-		return err
+		return nil, err
 		//log.Fatal(err)
 	}
 
-	// Camera orientation, e.g. if orientation value is 8 then top of camera was point right.
-	//    1
-	//  6   8
-	//    3
-	if orientation != nil {
-		if orientation.Val[0] == 8 {
-			img = imaging.Rotate90(img)
-		} else if orientation.Val[0] == 6 {
-			img = imaging.Rotate270(img)
-		} else if orientation.Val[0] == 3 {
-			img = imaging.Rotate180(img)
-		}
-	}
+	img = orientImage(img, orientation)
 
-	thumbnail := imaging.Thumbnail(img, 200, 200, imaging.Linear)
-
-	buf := new(bytes.Buffer)
-	jpeg.Encode(buf, thumbnail, &jpeg.Options{Quality: 75})
-	db.PutAsset([]byte(path), buf.Bytes(), dateTime)
+	thumbnails, err := makeThumbnails(img, thumbnailSizes)
+	if err != nil {
+		return nil, err
+	}
+	key := db.PutAsset([]byte(path), thumbnails, dateTime, meta)
 
 	////////////////////
 	// // Faster resize method, but seems to not like being multithreaded?
@@ -372,38 +316,147 @@ func storeThumbnail(path string, b []byte, orientation *tiff.Tag, dateTime time.
 
 	//db.PutAsset(assetDbKey, []byte(path), thumbnail, dateTime)
 
-	return nil
+	return key, nil
+}
+
+// orientImage rotates img so that it displays upright.
+func orientImage(img image.Image, orientation *tiff.Tag) image.Image {
+	// Camera orientation, e.g. if orientation value is 8 then top of camera was point right.
+	//    1
+	//  6   8
+	//    3
+	if orientation != nil {
+		if orientation.Val[0] == 8 {
+			img = imaging.Rotate90(img)
+		} else if orientation.Val[0] == 6 {
+			img = imaging.Rotate270(img)
+		} else if orientation.Val[0] == 3 {
+			img = imaging.Rotate180(img)
+		}
+	}
+	return img
+}
+
+var renderCacheDir = flag.String("render-cache", "rendercache", "directory for cached renditions")
+var renderCacheSize = flag.Int64("render-cache-size", 1024, "maximum size of the rendition cache in MB")
+
+// initCommandDB opens the database for a command, or, if the server holds
+// it, exits saying how to do the same through the server instead.
+func initCommandDB(instead string) {
+	if err := db.TryInit(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v, or while it runs %s\n", err, instead)
+		os.Exit(1)
+	}
 }
 
 func main() {
-	fmt.Println("Starting chronoshot version: 11.")
+	flag.Parse()
 
-	go logChannelMonitor()
+	switch flag.Arg(0) {
+	case "regenerate":
+		regenerateCommand(flag.Args()[1:])
+		return
+	case "adduser":
+		addUserCommand(flag.Args()[1:])
+		return
+	case "passwd":
+		passwdCommand(flag.Args()[1:])
+		return
+	}
+
+	if err := setupLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.Info("Starting chronoshot", "version", 11)
+
+	setupTimeZone()
+	setupTrash()
 	db.Init()
+	if *xmpUser != "" {
+		if _, ok := db.GetUser(*xmpUser); !ok {
+			log.Fatalf("-xmp-user %s does not exist", *xmpUser)
+		}
+	}
+	if *xmpWrite {
+		go sidecarWriter()
+	}
 
 	//dir := "/home/vin/Desktop"
 	//dir := "/media/data/photos"
 	dir := "/srv/data/photos"
 	//dir := "/home/vin/go/src/github.com/h2non/bimg/fixtures"
-	if len(os.Args) > 1 {
-		dir = os.Args[1]
+	if flag.NArg() > 0 {
+		dir = flag.Arg(0)
+	}
+
+	slog.Info("Photo directory set", "dir", dir)
+	setupUploads(dir)
+
+	if len(db.GetUsers()) == 0 {
+		slog.Warn("No users exist yet, create an admin with: chronoshot adduser -admin <name>")
 	}
 
-	chanLog <- strings.Join([]string{"Photo directory set to ", dir}, "")
-	//fmt.Println("Photo directory set to", dir)
+	var err error
+	renditions, err = newDiskCache(*renderCacheDir, *renderCacheSize<<20)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// xyzzy move this block, and all handlers, to separate file?
 	http.HandleFunc("/", rootHandler)
-	http.HandleFunc("/getThumbnail/", getThumbnailHandler)
-	http.HandleFunc("/getExifDateTime/", getExifDateTimeHandler)
-	http.HandleFunc("/getAsset/", getAssetHandler)
-	http.HandleFunc("/getAssetCount/", getAssetCountHandler)
-	http.HandleFunc("/getAssetInfos/", getAssetInfosHandler)
-	http.HandleFunc("/getSetArchive/", getSetArchiveHandler)
-	http.HandleFunc("/select/", selectHandler)
-	go http.ListenAndServe(":8080", nil)
-	fmt.Println("Webserver ready.")
-
+	http.HandleFunc("POST /login", loginHandler)
+	http.HandleFunc("POST /logout", logoutHandler)
+	// The original routes, kept as aliases of /api/v1 for existing clients.
+	http.HandleFunc("GET /getThumbnail/", withIDQuery(withAsset(serveThumbnail)))
+	http.HandleFunc("GET /getExifDateTime/", withIDQuery(withAsset(getExifDateTimeHandler)))
+	http.HandleFunc("GET /getAsset/", withIDQuery(withAsset(serveAsset)))
+	http.HandleFunc("GET /getAssetCount/", getAssetCountHandler)
+	http.HandleFunc("GET /getAssetInfos/", apiAssetsHandler)
+	http.HandleFunc("GET /getSetArchive/", getSetArchiveHandler)
+	http.HandleFunc("GET /select/", withIDQuery(withAsset(getSelectionHandler)))
+	http.HandleFunc("POST /select/", withOKStatus(withBodyAssetKey(withAsset(selectHandler))))
+	http.HandleFunc("GET /rate/", withIDQuery(withAsset(getRatingHandler)))
+	http.HandleFunc("POST /rate/", withOKStatus(withBodyAssetKey(withAsset(apiRatingHandler))))
+	http.HandleFunc("GET /api/albums", getAlbumsHandler)
+	http.HandleFunc("POST /api/albums", createAlbumHandler)
+	http.HandleFunc("PUT /api/albums/{id}", renameAlbumHandler)
+	http.HandleFunc("DELETE /api/albums/{id}", deleteAlbumHandler)
+	http.HandleFunc("POST /api/albums/{id}/assets", addAlbumAssetsHandler)
+	http.HandleFunc("DELETE /api/albums/{id}/assets/{assetId}", removeAlbumAssetHandler)
+	http.HandleFunc("PUT /api/albums/{id}/shares/{user}", shareAlbumHandler)
+	http.HandleFunc("DELETE /api/albums/{id}/shares/{user}", unshareAlbumHandler)
+	http.HandleFunc("GET /api/smart-albums", getSmartAlbumsHandler)
+	http.HandleFunc("POST /api/smart-albums", createSmartAlbumHandler)
+	http.HandleFunc("PUT /api/smart-albums/{id}", updateSmartAlbumHandler)
+	http.HandleFunc("DELETE /api/smart-albums/{id}", deleteSmartAlbumHandler)
+	http.HandleFunc("GET /api/shares", getSharesHandler)
+	http.HandleFunc("POST /api/shares", createShareHandler)
+	http.HandleFunc("DELETE /api/shares/{id}", deleteShareHandler)
+	http.HandleFunc("GET /api/search", searchHandler)
+	http.HandleFunc("GET /api/tokens", getTokensHandler)
+	http.HandleFunc("POST /api/tokens", createTokenHandler)
+	http.HandleFunc("DELETE /api/tokens/{id}", deleteTokenHandler)
+	http.HandleFunc("GET /s/{token}/{$}", sharePageHandler)
+	http.HandleFunc("POST /s/{token}/unlock", shareUnlockHandler)
+	http.HandleFunc("GET /s/{token}/getAssetInfos/", withShare(shareAssetInfosHandler))
+	http.HandleFunc("GET /s/{token}/getThumbnail/", withShare(shareThumbnailHandler))
+	http.HandleFunc("GET /s/{token}/getAsset/", withShare(shareAssetHandler))
+	http.HandleFunc("GET /api/assets/{id}/render", renderHandler)
+	http.HandleFunc("POST /admin/regenerate", regenerateHandler)
+	http.HandleFunc("POST /admin/export", exportHandler)
+	http.HandleFunc("POST /admin/purge", purgeHandler)
+	http.HandleFunc("GET /admin/jobs", getJobsHandler)
+	http.HandleFunc("GET /admin/jobs/{id}", getJobHandler)
+	http.HandleFunc("GET /metrics", metricsHandler)
+	http.HandleFunc("GET /healthz", healthzHandler)
+	http.HandleFunc("GET /readyz", readyzHandler)
+	registerAPIv1()
+	go handleSignals()
+	servers := serve(withRequestLogging(withMetrics(http.DefaultServeMux, withAPIErrors(requireAuth(http.DefaultServeMux)))))
+	slog.Info("Web server ready", "addr", *listenAddr)
+
+	start := time.Now()
 	if err := filepath.Walk(dir, processPhoto); err != nil {
 		log.Fatal(err)
 	}
@@ -416,27 +469,23 @@ func main() {
 		<-rateLimiter
 	}
 
-	fmt.Println("Watching for new images in", dir)
-	watchDirectory(dir)
-}
+	initialIndexDone.Store(true)
+	slog.Info("Initial index finished", "dir", dir, "duration", time.Since(start))
 
-var chanLog = make(chan string)
+	// None of these start if shutdown began during the walk.
+	background.Go(func() {
+		fillMissingThumbnails()
+		refreshMetadata()
+	})
+	background.Go(purgeExpiredTrash)
+	background.Go(expireUploads)
 
-func logChannelMonitor() {
-	logf, err := os.OpenFile("test.log", os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
-	if err != nil {
-		fmt.Printf("error opening file: %v", err)
+	if !isStopping() {
+		slog.Info("Watching for new images", "dir", dir)
+		watchDirectory(dir)
 	}
-	defer logf.Close()
-	log.SetOutput(logf)
-	mylogger := log.New(io.MultiWriter(logf, os.Stdout), "", 0)
 
-	for {
-		select {
-		case msg := <-chanLog:
-			mylogger.Println(strings.Join([]string{time.Now().String(), ": ", msg}, ""))
-		}
-	}
+	shutdown(servers)
 }
 
 // itob returns an 8-byte big endian representation of v.
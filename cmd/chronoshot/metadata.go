@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf16"
+
+	"chronoshot/pkg/db"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// metaVersion is stored with the metadata read from each asset. Raise it when
+// readMeta learns something new, and older assets are read again on startup.
+const metaVersion = 6
+
+// Camera defaults for ImageDescription that are not worth keeping as a
+// caption.
+var placeholderCaptions = map[string]bool{
+	"OLYMPUS DIGITAL CAMERA": true,
+	"SONY DSC":               true,
+	"DCIM":                   true,
+	"DIGITAL CAMERA":         true,
+}
+
+// readMeta reads the metadata from the photo at path, whose contents are b.
+// XMP comes from a sidecar if there is one, or is otherwise embedded. EXIF
+// captions are only used when there is no sidecar, which may have had its
+// caption cleared deliberately.
+func readMeta(path string, b []byte) db.AssetMeta {
+	sum := sha256.Sum256(b)
+	meta := db.AssetMeta{Version: metaVersion, ContentHash: hex.EncodeToString(sum[:])}
+	packet := findXMP(b)
+	sidecar, hasSidecar := findSidecar(path)
+	if hasSidecar {
+		var err error
+		if packet, err = os.ReadFile(sidecar); err != nil {
+			slog.Warn("Could not read sidecar", "path", sidecar, "err", err)
+		}
+	}
+	if packet != nil {
+		if x, err := readXMP(packet); err == nil {
+			applyXMP(&meta, x)
+		} else {
+			slog.Warn("Could not read XMP", "path", path, "err", err)
+		}
+	}
+
+	x, err := exif.Decode(bytes.NewReader(b))
+	if err != nil {
+		return meta
+	}
+	if meta.Caption == "" && !hasSidecar {
+		meta.Caption = exifString(x, exif.ImageDescription)
+		if placeholderCaptions[strings.ToUpper(meta.Caption)] {
+			meta.Caption = ""
+		}
+	}
+	if meta.Caption == "" && !hasSidecar {
+		meta.Caption = exifXPString(x, exif.XPComment)
+	}
+	cameraMake := exifString(x, exif.Make)
+	model := exifString(x, exif.Model)
+	// Models usually repeat the make, e.g. "Canon" "Canon EOS 5D".
+	if cameraMake != "" && !strings.HasPrefix(strings.ToLower(model), strings.ToLower(cameraMake)) {
+		model = strings.TrimSpace(cameraMake + " " + model)
+	}
+	meta.Camera = model
+	if _, zone, err := captureTime(x); err == nil {
+		meta.TimeZone = zone
+	}
+	return meta
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+// exifXPString reads one of the tags Windows writes as UTF-16LE bytes.
+func exifXPString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil || len(tag.Val)%2 != 0 {
+		return ""
+	}
+	u := make([]uint16, len(tag.Val)/2)
+	for i := range u {
+		u[i] = uint16(tag.Val[2*i]) | uint16(tag.Val[2*i+1])<<8
+	}
+	return strings.TrimSpace(strings.TrimRight(string(utf16.Decode(u)), "\x00"))
+}
+
+// refreshMetadata reads the metadata again for assets indexed before
+// metaVersion was last raised.
+func refreshMetadata() {
+	stale := db.GetAssetsWithOldMeta(metaVersion)
+	if len(stale) == 0 {
+		return
+	}
+	slog.Info("Reading metadata", "assets", len(stale))
+
+	var wg sync.WaitGroup
+	for _, key := range stale {
+		if isStopping() {
+			break
+		}
+		rateLimiter <- true
+		wg.Add(1)
+		go func(key []byte) {
+			defer func() { <-rateLimiter; wg.Done() }()
+			path := string(db.GetAssetPath(key))
+			b, err := os.ReadFile(path)
+			if err != nil {
+				slog.Error("Could not read metadata", "path", path, "err", err)
+				return
+			}
+			meta := readMeta(path, b)
+			old, err := db.PutAssetMeta(key, meta, false)
+			if err != nil {
+				slog.Error("Could not store metadata", "path", path, "err", err)
+				return
+			}
+			applySidecarUser(key, old, meta)
+			dateTime, _ := getExifDateTime(b)
+			if err := db.PutFileDateTime(key, dateTime); err != nil {
+				slog.Error("Could not store date", "path", path, "err", err)
+			}
+		}(key)
+	}
+	wg.Wait()
+
+	slog.Info("Finished reading metadata")
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"chronoshot/pkg/db"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chronoshot_http_requests_total",
+		Help: "HTTP requests served, by route pattern, method and status code.",
+	}, []string{"handler", "method", "code"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chronoshot_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests, by route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler"})
+
+	filesSeen = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chronoshot_indexer_files_seen_total",
+		Help: "Photos found by the initial walk or the watcher.",
+	})
+	filesIndexed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chronoshot_indexer_files_indexed_total",
+		Help: "Photos added to the database.",
+	})
+	filesFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chronoshot_indexer_files_failed_total",
+		Help: "Photos that could not be indexed.",
+	})
+	filesSkipped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chronoshot_indexer_files_skipped_total",
+		Help: "Photos skipped as already in the database.",
+	})
+	thumbnailDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "chronoshot_thumbnail_generation_seconds",
+		Help:    "Time taken to make the thumbnails for one photo.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		httpRequests,
+		httpRequestDuration,
+		filesSeen,
+		filesIndexed,
+		filesFailed,
+		filesSkipped,
+		thumbnailDuration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "chronoshot_indexer_queue_depth",
+			Help: "Photos being indexed or having thumbnails made, out of chronoshot_indexer_queue_capacity.",
+		}, func() float64 { return float64(len(rateLimiter)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "chronoshot_indexer_queue_capacity",
+			Help: "Photos that can be indexed at once.",
+		}, func() float64 { return float64(cap(rateLimiter)) }),
+		dbCollector{},
+	)
+}
+
+var (
+	dbSizeDesc = prometheus.NewDesc("chronoshot_db_size_bytes",
+		"Size of the database file.", nil, nil)
+	dbFreePagesDesc = prometheus.NewDesc("chronoshot_db_free_pages",
+		"Free pages in the database file.", nil, nil)
+	dbReadTxDesc = prometheus.NewDesc("chronoshot_db_read_transactions_total",
+		"Read transactions started.", nil, nil)
+	dbOpenReadTxDesc = prometheus.NewDesc("chronoshot_db_open_read_transactions",
+		"Read transactions currently open.", nil, nil)
+	dbPageAllocDesc = prometheus.NewDesc("chronoshot_db_page_alloc_bytes_total",
+		"Bytes allocated for pages by transactions.", nil, nil)
+	dbWritesDesc = prometheus.NewDesc("chronoshot_db_page_writes_total",
+		"Pages written to the database file.", nil, nil)
+	dbWriteTimeDesc = prometheus.NewDesc("chronoshot_db_write_seconds_total",
+		"Time spent writing to the database file.", nil, nil)
+	dbRebalancesDesc = prometheus.NewDesc("chronoshot_db_rebalances_total",
+		"Node rebalances performed by transactions.", nil, nil)
+	dbSpillsDesc = prometheus.NewDesc("chronoshot_db_spills_total",
+		"Node spills performed by transactions.", nil, nil)
+	setAssetsDesc = prometheus.NewDesc("chronoshot_set_assets",
+		"Assets in each set.", []string{"set"}, nil)
+)
+
+// dbCollector reads the database's stats and set sizes when scraped.
+type dbCollector struct{}
+
+func (dbCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{dbSizeDesc, dbFreePagesDesc, dbReadTxDesc, dbOpenReadTxDesc,
+		dbPageAllocDesc, dbWritesDesc, dbWriteTimeDesc, dbRebalancesDesc, dbSpillsDesc, setAssetsDesc} {
+		ch <- desc
+	}
+}
+
+func (dbCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, err := db.GetStats()
+	if err != nil {
+		slog.Error("Unable to read database stats", "err", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(dbSizeDesc, prometheus.GaugeValue, float64(stats.Size))
+	ch <- prometheus.MustNewConstMetric(dbFreePagesDesc, prometheus.GaugeValue, float64(stats.FreePages))
+	ch <- prometheus.MustNewConstMetric(dbReadTxDesc, prometheus.CounterValue, float64(stats.TxN))
+	ch <- prometheus.MustNewConstMetric(dbOpenReadTxDesc, prometheus.GaugeValue, float64(stats.OpenTxN))
+	ch <- prometheus.MustNewConstMetric(dbPageAllocDesc, prometheus.CounterValue, float64(stats.PageAllocs))
+	ch <- prometheus.MustNewConstMetric(dbWritesDesc, prometheus.CounterValue, float64(stats.Writes))
+	ch <- prometheus.MustNewConstMetric(dbWriteTimeDesc, prometheus.CounterValue, stats.WriteTime.Seconds())
+	ch <- prometheus.MustNewConstMetric(dbRebalancesDesc, prometheus.CounterValue, float64(stats.Rebalances))
+	ch <- prometheus.MustNewConstMetric(dbSpillsDesc, prometheus.CounterValue, float64(stats.Spills))
+
+	sizes, err := db.GetSetSizes()
+	if err != nil {
+		slog.Error("Unable to count sets", "err", err)
+		return
+	}
+	for set, n := range sizes {
+		ch <- prometheus.MustNewConstMetric(setAssetsDesc, prometheus.GaugeValue, float64(n), set)
+	}
+}
+
+// statusRecorder captures the status code and body size written by a
+// handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// withMetrics counts and times requests by the mux pattern they match,
+// which keeps IDs and tokens in paths out of the labels.
+func withMetrics(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		recorder := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		httpRequestDuration.WithLabelValues(pattern).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(pattern, r.Method, strconv.Itoa(recorder.status)).Inc()
+	})
+}
+
+// metricsHandler serves Prometheus metrics to admins, e.g. a scraper using
+// an API token with the read scope.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !currentUser(r).IsAdmin {
+		http.Error(w, "admin access required", http.StatusForbidden)
+		return
+	}
+	promhttp.Handler().ServeHTTP(w, r)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"chronoshot/pkg/db"
+)
+
+// regenerateRequest selects the assets whose thumbnails are rebuilt.
+type regenerateRequest struct {
+	Set         string
+	From        string
+	To          string
+	Concurrency int
+}
+
+// startRegenerate rebuilds every configured thumbnail size for the selected
+// assets in the background, replacing any existing thumbnails.
+func startRegenerate(user db.User, req regenerateRequest) (*job, error) {
+	if req.Set == "" {
+		req.Set = "all"
+	}
+	r, err := parseDateRange(req.From, req.To)
+	if err != nil {
+		return nil, err
+	}
+	if req.Concurrency <= 0 {
+		req.Concurrency = concurrency
+	}
+
+	assets, err := assetsInSet(user, req.Set, r)
+	if err != nil {
+		return nil, err
+	}
+	j, err := newJob("regenerate")
+	if err != nil {
+		return nil, err
+	}
+	j.SetTotal(len(assets))
+
+	go func() {
+		keys := make(chan string)
+		var wg sync.WaitGroup
+		for i := 0; i < req.Concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for key := range keys {
+					path := string(db.GetAssetPath([]byte(key)))
+					thumbnails, err := generateThumbnails(path, assetRotation(key), thumbnailSizes)
+					if err != nil {
+						j.Fail(path, err)
+						continue
+					}
+					db.PutThumbnails([]byte(key), thumbnails)
+					j.Succeed()
+				}
+			}()
+		}
+		var err error
+		for _, asset := range assets {
+			if isStopping() {
+				err = errStopped
+				break
+			}
+			keys <- asset.AssetKey
+		}
+		close(keys)
+		wg.Wait()
+
+		// Make sure the last thumbnails are stored before reporting completion.
+		db.Sync()
+		j.Finish(err)
+	}()
+
+	return j, nil
+}
+
+func regenerateHandler(w http.ResponseWriter, r *http.Request) {
+	var req regenerateRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	defer r.Body.Close()
+
+	j, err := startRegenerate(currentUser(r), req)
+	if err != nil {
+		http.Error(w, err.Error(), jobErrorStatus(err))
+		return
+	}
+	writeJSON(w, http.StatusAccepted, j.Progress())
+}
+
+// isUserSet reports whether the set is seen differently by each user, so
+// that it means nothing without one.
+func isUserSet(setName string) bool {
+	return setName == "selections" || strings.HasPrefix(setName, "album:") || strings.HasPrefix(setName, "smart:")
+}
+
+// regenerateCommand implements "chronoshot regenerate", reporting progress
+// on stdout until the job completes.
+func regenerateCommand(args []string) {
+	fs := flag.NewFlagSet("regenerate", flag.ExitOnError)
+	var req regenerateRequest
+	fs.StringVar(&req.Set, "set", "all", "set to regenerate")
+	fs.StringVar(&req.From, "from", "", "only assets taken on or after this date (YYYY-MM-DD)")
+	fs.StringVar(&req.To, "to", "", "only assets taken on or before this date (YYYY-MM-DD)")
+	fs.IntVar(&req.Concurrency, "concurrency", concurrency, "number of thumbnails generated at once")
+	userName := fs.String("user", "", "user whose favourites, albums or smart albums -set names")
+	fs.Parse(args)
+
+	if *userName == "" && isUserSet(req.Set) {
+		fmt.Fprintf(os.Stderr, "-set %s belongs to a user, name them with -user\n", req.Set)
+		os.Exit(2)
+	}
+
+	initCommandDB("an admin can start the job with POST /admin/regenerate or /api/v1/jobs/regenerate")
+
+	var user db.User
+	if *userName != "" {
+		var ok bool
+		if user, ok = db.GetUser(*userName); !ok {
+			fmt.Fprintf(os.Stderr, "no user named %q\n", *userName)
+			os.Exit(2)
+		}
+	}
+	j, err := startRegenerate(user, req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	for {
+		time.Sleep(time.Second)
+		p := j.Progress()
+		fmt.Printf("Regenerated %d/%d (%d failed)\n", p.Done, p.Total, p.Failed)
+		if p.Status != "running" {
+			for _, e := range p.Errors {
+				fmt.Println(e)
+			}
+			if p.Failed > 0 {
+				os.Exit(1)
+			}
+			return
+		}
+	}
+}
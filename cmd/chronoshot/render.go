@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+
+	"chronoshot/pkg/db"
+
+	"github.com/disintegration/imaging"
+)
+
+// Largest width or height a client may ask for.
+const maxRenditionSize = 8192
+
+var renditions *diskCache
+
+// renditionOptions describes a resized copy of an asset.
+type renditionOptions struct {
+	Width  int
+	Height int
+	Fit    string // contain, cover or stretch
+	Format string // jpeg or png
+}
+
+func parseRenditionOptions(r *http.Request) (renditionOptions, error) {
+	q := r.URL.Query()
+	opts := renditionOptions{Fit: q.Get("fit"), Format: q.Get("format")}
+
+	var err error
+	if s := q.Get("w"); s != "" {
+		if opts.Width, err = strconv.Atoi(s); err != nil || opts.Width < 0 || opts.Width > maxRenditionSize {
+			return opts, fmt.Errorf("invalid width %q", s)
+		}
+	}
+	if s := q.Get("h"); s != "" {
+		if opts.Height, err = strconv.Atoi(s); err != nil || opts.Height < 0 || opts.Height > maxRenditionSize {
+			return opts, fmt.Errorf("invalid height %q", s)
+		}
+	}
+	if opts.Width == 0 && opts.Height == 0 {
+		return opts, errors.New("at least one of w and h is required")
+	}
+
+	switch opts.Fit {
+	case "":
+		opts.Fit = "contain"
+	case "contain", "stretch":
+	case "cover":
+		if opts.Width == 0 || opts.Height == 0 {
+			return opts, errors.New("fit=cover requires both w and h")
+		}
+	default:
+		return opts, fmt.Errorf("invalid fit %q", opts.Fit)
+	}
+
+	switch opts.Format {
+	case "", "jpg", "jpeg":
+		opts.Format = "jpeg"
+	case "png":
+	default:
+		return opts, fmt.Errorf("invalid format %q", opts.Format)
+	}
+
+	return opts, nil
+}
+
+// renderAsset decodes the photo at path, corrects its orientation, or turns
+// it by rotation if that is not nil, and resizes it according to opts.
+// Renditions are never larger than the original.
+func renderAsset(path string, rotation *db.Rotation, opts renditionOptions) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	_, orientation := getExifDateTime(b)
+
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	img = orientAsset(img, orientation, rotation)
+
+	bounds := img.Bounds()
+	width, height := opts.Width, opts.Height
+
+	var resized image.Image
+	switch opts.Fit {
+	case "cover":
+		width, height = scaleWithin(width, height, bounds.Dx(), bounds.Dy())
+		resized = imaging.Fill(img, width, height, imaging.Center, imaging.CatmullRom)
+	case "stretch":
+		width, height = scaleWithin(width, height, bounds.Dx(), bounds.Dy())
+		resized = imaging.Resize(img, width, height, imaging.CatmullRom)
+	default:
+		// Fit keeps the photo's own shape, so each side is capped alone.
+		width, height = min(width, bounds.Dx()), min(height, bounds.Dy())
+		if width == 0 {
+			width = bounds.Dx()
+		}
+		if height == 0 {
+			height = bounds.Dy()
+		}
+		resized = imaging.Fit(img, width, height, imaging.CatmullRom)
+	}
+
+	buf := new(bytes.Buffer)
+	if opts.Format == "png" {
+		err = imaging.Encode(buf, resized, imaging.PNG)
+	} else {
+		err = imaging.Encode(buf, resized, imaging.JPEG, imaging.JPEGQuality(85))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleWithin shrinks width and height by the same factor until neither is
+// larger than the source's, so that the shape asked for is kept. A zero
+// side stays zero.
+func scaleWithin(width, height, sourceWidth, sourceHeight int) (int, int) {
+	scale := 1.0
+	if width > sourceWidth {
+		scale = float64(sourceWidth) / float64(width)
+	}
+	if height > sourceHeight {
+		scale = min(scale, float64(sourceHeight)/float64(height))
+	}
+	if scale == 1 {
+		return width, height
+	}
+	shrink := func(n int) int {
+		if n == 0 {
+			return 0
+		}
+		return max(1, int(math.Round(float64(n)*scale)))
+	}
+	return shrink(width), shrink(height)
+}
+
+// renditionCacheName identifies a rendition on disk. The source file's size
+// and modification time are included so that edited originals are re-rendered,
+// as is any rotation set for the asset.
+func renditionCacheName(id string, info os.FileInfo, rotation *db.Rotation, opts renditionOptions) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s|%d|%d|%d|%d|%s", id, info.Size(), info.ModTime().UnixNano(), opts.Width, opts.Height, opts.Fit)
+	if rotation != nil {
+		fmt.Fprintf(h, "|%d|%t", rotation.Degrees, rotation.Flip)
+	}
+	return hex.EncodeToString(h.Sum(nil)) + "." + opts.Format
+}
+
+func renderHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("id")
+
+	if !db.KeyExists([]byte(key)) {
+		requestLogger(r).Info("Key does not exist", "key", key)
+		http.NotFound(w, r)
+		return
+	}
+
+	opts, err := parseRenditionOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	serveRendition(w, r, key, opts)
+}
+
+func serveRendition(w http.ResponseWriter, r *http.Request, key string, opts renditionOptions) {
+	imgPath := string(db.GetAssetPath([]byte(key)))
+	info, err := os.Stat(imgPath)
+	if err != nil {
+		requestLogger(r).Warn("Could not open asset", "path", imgPath, "err", err)
+		http.NotFound(w, r)
+		return
+	}
+
+	rotation := assetRotation(key)
+	name := renditionCacheName(key, info, rotation, opts)
+	// The URL stays the same when the photo is rotated, so browsers have to
+	// check the ETag, which changes with it, every time.
+	etag := `"` + name + `"`
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	buf, err := renditions.Get(name, func() ([]byte, error) {
+		return renderAsset(imgPath, rotation, opts)
+	})
+	if err != nil {
+		requestLogger(r).Error("Could not render", "path", imgPath, "err", err)
+		http.Error(w, "could not render asset", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/"+opts.Format)
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	if _, err := w.Write(buf); err != nil {
+		requestLogger(r).Debug("Unable to write image", "err", err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRenditionOptions(t *testing.T) {
+	tests := []struct {
+		query string
+		want  renditionOptions
+	}{
+		{"w=200", renditionOptions{Width: 200, Fit: "contain", Format: "jpeg"}},
+		{"h=100&format=jpg", renditionOptions{Height: 100, Fit: "contain", Format: "jpeg"}},
+		{"w=200&h=100&fit=cover&format=png", renditionOptions{Width: 200, Height: 100, Fit: "cover", Format: "png"}},
+		{"w=8192&fit=stretch", renditionOptions{Width: 8192, Fit: "stretch", Format: "jpeg"}},
+	}
+	for _, test := range tests {
+		got, err := parseRenditionOptions(httptest.NewRequest("GET", "/?"+test.query, nil))
+		if err != nil {
+			t.Errorf("%s: %v", test.query, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestParseRenditionOptionsErrors(t *testing.T) {
+	for _, query := range []string{
+		"",
+		"w=0&h=0",
+		"w=-1",
+		"w=8193",
+		"h=abc",
+		"w=200&fit=cover",
+		"w=200&fit=fill",
+		"w=200&format=gif",
+	} {
+		if got, err := parseRenditionOptions(httptest.NewRequest("GET", "/?"+query, nil)); err == nil {
+			t.Errorf("%q: got %+v, want an error", query, got)
+		}
+	}
+}
+
+func TestScaleWithin(t *testing.T) {
+	tests := []struct {
+		width, height, wantWidth, wantHeight int
+	}{
+		{200, 100, 200, 100},
+		{1000, 100, 800, 80},
+		{400, 1200, 200, 600},
+		{1600, 1200, 800, 600},
+		{1000, 0, 800, 0},
+		{0, 0, 0, 0},
+	}
+	for _, test := range tests {
+		width, height := scaleWithin(test.width, test.height, 800, 600)
+		if width != test.wantWidth || height != test.wantHeight {
+			t.Errorf("scaleWithin(%d, %d) = %d, %d, want %d, %d",
+				test.width, test.height, width, height, test.wantWidth, test.wantHeight)
+		}
+	}
+}
+
+func TestRenderAssetKeepsAspectRatio(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "photo.jpg")
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 80, 60)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		opts       renditionOptions
+		wantBounds image.Rectangle
+	}{
+		{renditionOptions{Width: 100, Height: 10, Fit: "cover"}, image.Rect(0, 0, 80, 8)},
+		{renditionOptions{Width: 20, Height: 120, Fit: "stretch"}, image.Rect(0, 0, 10, 60)},
+		{renditionOptions{Width: 40, Height: 40, Fit: "cover"}, image.Rect(0, 0, 40, 40)},
+		{renditionOptions{Width: 200, Height: 30, Fit: "contain"}, image.Rect(0, 0, 40, 30)},
+		{renditionOptions{Width: 200, Fit: "contain"}, image.Rect(0, 0, 80, 60)},
+	}
+	for _, test := range tests {
+		test.opts.Format = "jpeg"
+		b, err := renderAsset(path, nil, test.opts)
+		if err != nil {
+			t.Fatalf("%+v: %v", test.opts, err)
+		}
+		config, err := jpeg.DecodeConfig(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%+v: %v", test.opts, err)
+		}
+		if got := image.Rect(0, 0, config.Width, config.Height); got != test.wantBounds {
+			t.Errorf("%+v: rendered %v, want %v", test.opts, got, test.wantBounds)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"image"
+	"net/http"
+	"os"
+	"slices"
+
+	"chronoshot/pkg/db"
+
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+var rotationWrite = flag.Bool("rotation-write", false, "write rotations set in chronoshot to the EXIF orientation of the original photos")
+
+// exifOrientations maps each rotation to the EXIF orientation that shows a
+// photo the same way.
+var exifOrientations = map[db.Rotation]uint16{
+	{Degrees: 0}:               1,
+	{Degrees: 0, Flip: true}:   2,
+	{Degrees: 180}:             3,
+	{Degrees: 180, Flip: true}: 4,
+	{Degrees: 270, Flip: true}: 5,
+	{Degrees: 90}:              6,
+	{Degrees: 90, Flip: true}:  7,
+	{Degrees: 270}:             8,
+}
+
+// assetRotation returns the rotation set for the asset with key, or nil if
+// its EXIF orientation is used.
+func assetRotation(key string) *db.Rotation {
+	if r, ok := db.GetAssetRotation([]byte(key)); ok {
+		return &r
+	}
+	return nil
+}
+
+// orientAsset turns img the right way up with rotation if one is set, and
+// with its EXIF orientation otherwise.
+func orientAsset(img image.Image, orientation *tiff.Tag, rotation *db.Rotation) image.Image {
+	if rotation == nil {
+		return orientImage(img, orientation)
+	}
+	if rotation.Flip {
+		img = imaging.FlipH(img)
+	}
+	// imaging rotates anticlockwise.
+	switch rotation.Degrees {
+	case 90:
+		img = imaging.Rotate270(img)
+	case 180:
+		img = imaging.Rotate180(img)
+	case 270:
+		img = imaging.Rotate90(img)
+	}
+	return img
+}
+
+// apiRotationHandler sets the asset's rotation on PUT, and goes back to its
+// EXIF orientation on DELETE. Its thumbnails are made again straight away;
+// renditions are made again when next asked for.
+func apiRotationHandler(w http.ResponseWriter, r *http.Request, key string) {
+	var rotation *db.Rotation
+	if r.Method == "PUT" {
+		rotation = new(db.Rotation)
+		if err := json.NewDecoder(r.Body).Decode(rotation); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+		if err := rotation.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := db.PutAssetRotation([]byte(key), rotation); err != nil {
+		if err == db.ErrAssetNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	path := string(db.GetAssetPath([]byte(key)))
+	thumbnails, err := generateThumbnails(path, rotation, thumbnailSizes)
+	if err != nil {
+		requestLogger(r).Error("Could not generate thumbnails", "path", path, "err", err)
+		http.Error(w, "could not generate thumbnails", http.StatusInternalServerError)
+		return
+	}
+	db.PutThumbnails([]byte(key), thumbnails)
+	db.Sync()
+
+	if *rotationWrite && rotation != nil {
+		if err := writeOrientation(path, exifOrientations[*rotation]); err != nil {
+			requestLogger(r).Warn("Could not write orientation", "path", path, "err", err)
+		} else {
+			requestLogger(r).Info("Wrote orientation", "path", path)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var errNoOrientationTag = errors.New("photo has EXIF but no orientation to update")
+
+// writeOrientation sets the EXIF orientation of the JPEG at path, replacing
+// the file.
+func writeOrientation(path string, orientation uint16) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	updated, err := setJPEGOrientation(b, orientation)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	part := path + ".part"
+	if err := os.WriteFile(part, updated, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Rename(part, path); err != nil {
+		os.Remove(part)
+		return err
+	}
+	return nil
+}
+
+// setJPEGOrientation returns a copy of the JPEG b with its orientation
+// changed. Photos without EXIF are given an EXIF segment holding just the
+// orientation; photos whose EXIF has no orientation are left alone, as
+// adding a tag would mean rewriting every offset after it.
+func setJPEGOrientation(b []byte, orientation uint16) ([]byte, error) {
+	if len(b) < 4 || b[0] != 0xFF || b[1] != 0xD8 {
+		return nil, errors.New("not a JPEG")
+	}
+	insertAt := 2
+	for i := 2; i+4 <= len(b) && b[i] == 0xFF; {
+		marker := b[i+1]
+		if marker == 0xDA { // start of scan
+			break
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(b[i+2:]))
+		if end < i+4 || end > len(b) {
+			return nil, errors.New("corrupt JPEG segment")
+		}
+		if marker == 0xE1 && bytes.HasPrefix(b[i+4:end], []byte("Exif\x00\x00")) {
+			updated := bytes.Clone(b)
+			if err := patchOrientation(updated[i+10:end], orientation); err != nil {
+				return nil, err
+			}
+			return updated, nil
+		}
+		if marker == 0xE0 {
+			// EXIF goes after JFIF.
+			insertAt = end
+		}
+		i = end
+	}
+	return slices.Concat(b[:insertAt], orientationSegment(orientation), b[insertAt:]), nil
+}
+
+// patchOrientation changes the orientation in the first IFD of the TIFF
+// data t.
+func patchOrientation(t []byte, orientation uint16) error {
+	if len(t) < 8 {
+		return errors.New("corrupt EXIF")
+	}
+	var order binary.ByteOrder
+	switch string(t[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return errors.New("corrupt EXIF")
+	}
+	ifd := int(order.Uint32(t[4:]))
+	if ifd < 8 || ifd+2 > len(t) {
+		return errors.New("corrupt EXIF")
+	}
+	n := int(order.Uint16(t[ifd:]))
+	for k := 0; k < n; k++ {
+		e := ifd + 2 + 12*k
+		if e+12 > len(t) {
+			return errors.New("corrupt EXIF")
+		}
+		// A SHORT, which fits in the entry itself.
+		if order.Uint16(t[e:]) == 0x0112 && order.Uint16(t[e+2:]) == 3 {
+			order.PutUint16(t[e+8:], orientation)
+			return nil
+		}
+	}
+	return errNoOrientationTag
+}
+
+// orientationSegment returns an APP1 segment with EXIF holding only the
+// orientation.
+func orientationSegment(orientation uint16) []byte {
+	le := binary.LittleEndian
+	t := []byte("Exif\x00\x00II*\x00")
+	t = le.AppendUint32(t, 8) // first IFD
+	t = le.AppendUint16(t, 1) // entries
+	t = le.AppendUint16(t, 0x0112)
+	t = le.AppendUint16(t, 3) // SHORT
+	t = le.AppendUint32(t, 1)
+	t = le.AppendUint16(t, orientation)
+	t = le.AppendUint16(t, 0)
+	t = le.AppendUint32(t, 0) // no next IFD
+	segment := []byte{0xFF, 0xE1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(t)+2))
+	return append(segment, t...)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"slices"
+	"testing"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// testJPEG returns a small JPEG with the given segments after SOI.
+func testJPEG(t *testing.T, segments ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	return slices.Concat(append([][]byte{b[:2]}, append(segments, b[2:])...)...)
+}
+
+func jfifSegment() []byte {
+	data := []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")
+	segment := []byte{0xFF, 0xE0}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(data)+2))
+	return append(segment, data...)
+}
+
+// byteOrder is binary.LittleEndian or binary.BigEndian.
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// exifSegment returns an APP1 segment whose first IFD has SHORT tags with
+// the given values.
+func exifSegment(order byteOrder, tags ...[2]uint16) []byte {
+	t := []byte("Exif\x00\x00")
+	if order == binary.LittleEndian {
+		t = append(t, "II"...)
+	} else {
+		t = append(t, "MM"...)
+	}
+	t = order.AppendUint16(t, 42)
+	t = order.AppendUint32(t, 8)
+	t = order.AppendUint16(t, uint16(len(tags)))
+	for _, tag := range tags {
+		t = order.AppendUint16(t, tag[0])
+		t = order.AppendUint16(t, 3)
+		t = order.AppendUint32(t, 1)
+		t = order.AppendUint16(t, tag[1])
+		t = order.AppendUint16(t, 0)
+	}
+	t = order.AppendUint32(t, 0)
+	segment := []byte{0xFF, 0xE1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(t)+2))
+	return append(segment, t...)
+}
+
+// decodedOrientation reads the orientation back with goexif, checking that
+// the photo still decodes.
+func decodedOrientation(t *testing.T, b []byte) int {
+	t.Helper()
+	if _, err := jpeg.Decode(bytes.NewReader(b)); err != nil {
+		t.Fatalf("photo no longer decodes: %v", err)
+	}
+	x, err := exif.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("exif.Decode: %v", err)
+	}
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		t.Fatalf("no orientation: %v", err)
+	}
+	o, err := tag.Int(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestSetJPEGOrientationWithoutEXIF(t *testing.T) {
+	for name, b := range map[string][]byte{
+		"bare": testJPEG(t),
+		"jfif": testJPEG(t, jfifSegment()),
+	} {
+		updated, err := setJPEGOrientation(b, 6)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := decodedOrientation(t, updated); got != 6 {
+			t.Errorf("%s: orientation %d, want 6", name, got)
+		}
+		// The JFIF segment has to stay first.
+		if name == "jfif" && !bytes.HasPrefix(updated[2:], jfifSegment()) {
+			t.Errorf("%s: EXIF was not inserted after JFIF", name)
+		}
+	}
+}
+
+func TestSetJPEGOrientationByteOrders(t *testing.T) {
+	for _, order := range []byteOrder{binary.LittleEndian, binary.BigEndian} {
+		// ResolutionUnit before the orientation.
+		b := testJPEG(t, jfifSegment(), exifSegment(order, [2]uint16{0x0128, 2}, [2]uint16{0x0112, 1}))
+		updated, err := setJPEGOrientation(b, 8)
+		if err != nil {
+			t.Fatalf("%v: %v", order, err)
+		}
+		if len(updated) != len(b) {
+			t.Errorf("%v: length changed from %d to %d", order, len(b), len(updated))
+		}
+		if got := decodedOrientation(t, updated); got != 8 {
+			t.Errorf("%v: orientation %d, want 8", order, got)
+		}
+		if got := decodedOrientation(t, b); got != 1 {
+			t.Errorf("%v: original changed to %d", order, got)
+		}
+	}
+}
+
+func TestSetJPEGOrientationWithoutTag(t *testing.T) {
+	b := testJPEG(t, exifSegment(binary.BigEndian, [2]uint16{0x0128, 2}))
+	if _, err := setJPEGOrientation(b, 6); err != errNoOrientationTag {
+		t.Errorf("got %v, want errNoOrientationTag", err)
+	}
+}
+
+func TestSetJPEGOrientationCorrupt(t *testing.T) {
+	for name, b := range map[string][]byte{
+		"not a jpeg":     []byte("GIF89a...."),
+		"long segment":   slices.Concat([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0xFF, 0xFF}, []byte("Exif\x00\x00II")),
+		"short segment":  []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x01, 0xFF, 0xD9},
+		"truncated tiff": slices.Concat([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x0A}, []byte("Exif\x00\x00II*\x00")),
+	} {
+		if _, err := setJPEGOrientation(b, 6); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestExifOrientationsRoundTrip(t *testing.T) {
+	for rotation, orientation := range exifOrientations {
+		b, err := setJPEGOrientation(testJPEG(t), orientation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := decodedOrientation(t, b); got != int(orientation) {
+			t.Errorf("%+v: orientation %d, want %d", rotation, got, orientation)
+		}
+	}
+}
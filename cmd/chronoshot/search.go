@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"chronoshot/pkg/db"
+)
+
+// searchQuery is a parsed search. Assets match if they have a word starting
+// with each term, were taken within Dates and pass the remaining filters.
+type searchQuery struct {
+	Terms     []db.SearchTerm
+	Dates     dateRange
+	MinRating int   // the searching user's rating, 0 for any
+	Favourite bool  // only the searching user's favourites
+	Tagged    *bool // nil for either
+}
+
+// and returns a query matching assets that match both q and other.
+func (q searchQuery) and(other searchQuery) searchQuery {
+	q.Terms = append(append([]db.SearchTerm{}, q.Terms...), other.Terms...)
+	if !other.Dates.From.IsZero() && other.Dates.From.After(q.Dates.From) {
+		q.Dates.From = other.Dates.From
+	}
+	if !other.Dates.To.IsZero() && (q.Dates.To.IsZero() || other.Dates.To.Before(q.Dates.To)) {
+		q.Dates.To = other.Dates.To
+	}
+	q.MinRating = max(q.MinRating, other.MinRating)
+	q.Favourite = q.Favourite || other.Favourite
+	if other.Tagged != nil {
+		q.Tagged = other.Tagged
+	}
+	return q
+}
+
+// Qualifiers that limit a term to one search field.
+var searchQualifiers = map[string]string{
+	"camera":  db.SearchCamera,
+	"caption": db.SearchText,
+	"folder":  db.SearchFolder,
+	"file":    db.SearchFile,
+	"label":   db.SearchLabel,
+	"place":   db.SearchPlace,
+	"tag":     db.SearchTag,
+}
+
+// parseSearchQuery parses queries such as
+//
+//	beach folder:holidays camera:"eos 5d" after:2019-06 before:2020
+//	rating:4 is:favourite is:untagged after:-1mo before:-0mo
+//
+// Words match any indexed field by prefix, so "hol" finds "holidays". Quoted
+// text is kept together as the value of a qualifier. before: is exclusive
+// and after: inclusive, and both take YYYY, YYYY-MM, YYYY-MM-DD, RFC 3339 or
+// a relative date, see parseSearchDate. rating: matches that rating or
+// higher. Anything else that looks like a qualifier is searched for as text.
+func parseSearchQuery(q string) (searchQuery, error) {
+	var query searchQuery
+	for _, token := range splitSearchQuery(q) {
+		name, value, found := strings.Cut(token, ":")
+		name = strings.ToLower(name)
+		switch {
+		case found && name == "rating":
+			rating, err := strconv.Atoi(value)
+			if err != nil || rating < 1 || rating > 5 {
+				return query, fmt.Errorf("invalid rating %q, expected 1 to 5", value)
+			}
+			query.MinRating = max(query.MinRating, rating)
+		case found && name == "is" && strings.EqualFold(value, "favourite"):
+			query.Favourite = true
+		case found && name == "is" && (strings.EqualFold(value, "tagged") || strings.EqualFold(value, "untagged")):
+			tagged := strings.EqualFold(value, "tagged")
+			query.Tagged = &tagged
+		case found && (name == "before" || name == "after"):
+			t, err := parseSearchDate(value, time.Now().In(defaultZone))
+			if err != nil {
+				return query, err
+			}
+			if name == "before" {
+				if query.Dates.To.IsZero() || t.Before(query.Dates.To) {
+					query.Dates.To = t
+				}
+			} else if query.Dates.From.IsZero() || t.After(query.Dates.From) {
+				query.Dates.From = t
+			}
+		case found && searchQualifiers[name] != "":
+			for _, word := range db.Tokenise(value) {
+				query.Terms = append(query.Terms, db.SearchTerm{Field: searchQualifiers[name], Prefix: word})
+			}
+		default:
+			for _, word := range db.Tokenise(token) {
+				query.Terms = append(query.Terms, db.SearchTerm{Field: db.SearchAny, Prefix: word})
+			}
+		}
+	}
+	return query, nil
+}
+
+// splitSearchQuery splits q on spaces outside double quotes, dropping the
+// quotes.
+func splitSearchQuery(q string) []string {
+	var tokens []string
+	var token strings.Builder
+	quoted := false
+	for _, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if token.Len() > 0 {
+				tokens = append(tokens, token.String())
+				token.Reset()
+			}
+		default:
+			token.WriteRune(r)
+		}
+	}
+	if token.Len() > 0 {
+		tokens = append(tokens, token.String())
+	}
+	return tokens
+}
+
+// parseSearchDate returns the start of the year, month or day given in
+// defaultZone, or the exact time for RFC 3339. Relative dates count back from
+// the start of the current day, week (from Monday), month or year, in the
+// units of date shifts, so -0mo is the start of this month and -1mo the start
+// of last month. Months may also be given as m, which has no other meaning
+// here.
+func parseSearchDate(s string, now time.Time) (time.Time, error) {
+	if t, ok := parseRelativeDate(s, now); ok {
+		return t, nil
+	}
+	for _, layout := range []string{"2006", "2006-01", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, defaultZone); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q, expected YYYY, YYYY-MM, YYYY-MM-DD, RFC 3339 or -N followed by d, w, mo or y", s)
+}
+
+func parseRelativeDate(s string, now time.Time) (time.Time, bool) {
+	if len(s) < 3 || s[0] != '-' {
+		return time.Time{}, false
+	}
+	i := strings.LastIndexAny(s, "0123456789") + 1
+	if i < 2 {
+		return time.Time{}, false
+	}
+	n, err := strconv.Atoi(s[1:i])
+	if err != nil || n < 0 {
+		return time.Time{}, false
+	}
+	year, month, day := now.Date()
+	switch s[i:] {
+	case "d":
+		return time.Date(year, month, day-n, 0, 0, 0, 0, now.Location()), true
+	case "w":
+		monday := day - (int(now.Weekday())+6)%7
+		return time.Date(year, month, monday-7*n, 0, 0, 0, 0, now.Location()), true
+	case "mo", "m":
+		return time.Date(year, month-time.Month(n), 1, 0, 0, 0, 0, now.Location()), true
+	case "y":
+		return time.Date(year-n, 1, 1, 0, 0, 0, 0, now.Location()), true
+	}
+	return time.Time{}, false
+}
+
+// search returns the assets in a set, as seen by user, that match query.
+// Searching a smart album narrows its saved query.
+func search(user db.User, setName string, query searchQuery) ([]db.Asset, error) {
+	if id, ok := strings.CutPrefix(setName, "smart:"); ok {
+		album, err := db.GetSmartAlbum(user.Name, id)
+		if err != nil {
+			return nil, err
+		}
+		saved, err := parseSearchQuery(album.Query)
+		if err != nil {
+			return nil, err
+		}
+		query = saved.and(query)
+		setName = "all"
+	}
+
+	bucket, err := db.ResolveSet(user.Name, setName)
+	if err != nil {
+		return nil, err
+	}
+	var ratings map[string]int
+	if query.MinRating > 0 {
+		ratings = db.GetRatings(user.Name)
+	}
+	var favourites map[string]bool
+	if query.Favourite {
+		selections, err := db.ResolveSet(user.Name, "selections")
+		if err != nil {
+			return nil, err
+		}
+		favourites = make(map[string]bool)
+		for _, asset := range db.GetAllAssetKeys(selections) {
+			favourites[asset.AssetKey] = true
+		}
+	}
+	var tagged map[string]bool
+	if query.Tagged != nil {
+		tagged = db.GetTaggedAssets()
+	}
+
+	var assets []db.Asset
+	for _, asset := range db.Search(bucket, query.Terms) {
+		switch {
+		case !query.Dates.Contains(asset.DateTime):
+		case query.MinRating > 0 && ratings[asset.AssetKey] < query.MinRating:
+		case query.Favourite && !favourites[asset.AssetKey]:
+		case query.Tagged != nil && tagged[asset.AssetKey] != *query.Tagged:
+		default:
+			assets = append(assets, asset)
+		}
+	}
+	return assets, nil
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := parseSearchQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	setName := r.URL.Query().Get("set")
+	if setName == "" {
+		setName = "all"
+	}
+
+	assets, err := search(currentUser(r), setName, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if assets == nil {
+		assets = []db.Asset{}
+	}
+	writeJSON(w, http.StatusOK, assets)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"chronoshot/pkg/db"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	saved := defaultZone
+	defaultZone = time.FixedZone("test", 3600)
+	t.Cleanup(func() { defaultZone = saved })
+
+	term := func(field, prefix string) db.SearchTerm {
+		return db.SearchTerm{Field: field, Prefix: prefix}
+	}
+	tagged, untagged := true, false
+	tests := []struct {
+		q    string
+		want searchQuery
+	}{
+		{"", searchQuery{}},
+		{"Beach hol-2019", searchQuery{Terms: []db.SearchTerm{
+			term(db.SearchAny, "beach"), term(db.SearchAny, "hol"), term(db.SearchAny, "2019"),
+		}}},
+		{`folder:holidays camera:"EOS 5D" tag:family`, searchQuery{Terms: []db.SearchTerm{
+			term(db.SearchFolder, "holidays"), term(db.SearchCamera, "eos"), term(db.SearchCamera, "5d"), term(db.SearchTag, "family"),
+		}}},
+		{`place:"São Paulo" Caption:birthday label:red file:img`, searchQuery{Terms: []db.SearchTerm{
+			term(db.SearchPlace, "são"), term(db.SearchPlace, "paulo"), term(db.SearchText, "birthday"),
+			term(db.SearchLabel, "red"), term(db.SearchFile, "img"),
+		}}},
+		// Not a qualifier, so searched for as text.
+		{"colour:red", searchQuery{Terms: []db.SearchTerm{term(db.SearchAny, "colour"), term(db.SearchAny, "red")}}},
+		{"after:2019-06 before:2020", searchQuery{Dates: dateRange{
+			From: time.Date(2019, 6, 1, 0, 0, 0, 0, defaultZone),
+			To:   time.Date(2020, 1, 1, 0, 0, 0, 0, defaultZone),
+		}}},
+		// The narrowest bounds win.
+		{"after:2019 after:2019-03-02 before:2021 before:2020-12-25T10:00:00Z", searchQuery{Dates: dateRange{
+			From: time.Date(2019, 3, 2, 0, 0, 0, 0, defaultZone),
+			To:   time.Date(2020, 12, 25, 10, 0, 0, 0, time.UTC),
+		}}},
+		{"rating:2 rating:4 is:Favourite", searchQuery{MinRating: 4, Favourite: true}},
+		{"is:tagged", searchQuery{Tagged: &tagged}},
+		{"is:tagged is:untagged", searchQuery{Tagged: &untagged}},
+	}
+	for _, test := range tests {
+		got, err := parseSearchQuery(test.q)
+		if err != nil {
+			t.Errorf("%q: %v", test.q, err)
+			continue
+		}
+		if !slices.Equal(got.Terms, test.want.Terms) {
+			t.Errorf("%q: terms %v, want %v", test.q, got.Terms, test.want.Terms)
+		}
+		if !got.Dates.From.Equal(test.want.Dates.From) || !got.Dates.To.Equal(test.want.Dates.To) {
+			t.Errorf("%q: dates %v, want %v", test.q, got.Dates, test.want.Dates)
+		}
+		got.Terms, got.Dates, test.want.Terms, test.want.Dates = nil, dateRange{}, nil, dateRange{}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %+v, want %+v", test.q, got, test.want)
+		}
+	}
+}
+
+func TestParseSearchQueryErrors(t *testing.T) {
+	for _, q := range []string{
+		"rating:0",
+		"rating:6",
+		"rating:high",
+		"after:2019-13",
+		"before:yesterday",
+		"after:-1q",
+	} {
+		if got, err := parseSearchQuery(q); err == nil {
+			t.Errorf("%q: got %+v, want an error", q, got)
+		}
+	}
+}
+
+func TestParseRelativeDate(t *testing.T) {
+	// A Wednesday.
+	now := time.Date(2024, 3, 13, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		s    string
+		want time.Time
+	}{
+		{"-0d", time.Date(2024, 3, 13, 0, 0, 0, 0, time.UTC)},
+		{"-2d", time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)},
+		{"-0w", time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)},
+		{"-1w", time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)},
+		{"-0m", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"-3m", time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC)},
+		{"-0mo", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"-14mo", time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"-1y", time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		got, ok := parseRelativeDate(test.s, now)
+		if !ok || !got.Equal(test.want) {
+			t.Errorf("parseRelativeDate(%q) = %v, %t, want %v", test.s, got, ok, test.want)
+		}
+	}
+	// Only the units of date shifts that make sense here.
+	for _, s := range []string{"-d", "-mo", "1d", "--1d", "-1h", "-1min", "-1mon", "-1 mo", "2024"} {
+		if got, ok := parseRelativeDate(s, now); ok {
+			t.Errorf("parseRelativeDate(%q) = %v, want nothing", s, got)
+		}
+	}
+}
+
+func TestSplitSearchQuery(t *testing.T) {
+	got := splitSearchQuery(`  beach  camera:"eos 5d"  "two words" `)
+	if want := []string{"beach", "camera:eos 5d", "two words"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
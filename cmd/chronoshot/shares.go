@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"chronoshot/pkg/db"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Longest side of the image served in place of the original when a share
+// link does not allow downloads.
+const sharePreviewSize = 2048
+
+var shareSecret []byte
+var shareSecretOnce sync.Once
+
+func getShareSecret() []byte {
+	shareSecretOnce.Do(func() { shareSecret = db.GetSecret("shares") })
+	return shareSecret
+}
+
+func sign(message string) string {
+	mac := hmac.New(sha256.New, getShareSecret())
+	mac.Write([]byte(message))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// shareToken is the link ID signed with the server's secret, so that links
+// cannot be guessed from their IDs.
+func shareToken(id string) string {
+	return id + "." + sign(id)
+}
+
+func shareFromToken(token string) (db.ShareLink, bool) {
+	id, _, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(shareToken(id)), []byte(token)) {
+		return db.ShareLink{}, false
+	}
+	share, err := db.GetShareLink(id)
+	if err != nil || share.Expired() {
+		return db.ShareLink{}, false
+	}
+	return share, true
+}
+
+// The unlock cookie is bound to the password hash, so changing the password
+// locks out everyone who unlocked with the old one.
+func shareUnlockCookieName(share db.ShareLink) string {
+	return "chronoshot_share_" + share.ID
+}
+
+func shareUnlockValue(share db.ShareLink) string {
+	return sign("unlocked:" + share.ID + ":" + string(share.PasswordHash))
+}
+
+func isShareUnlocked(r *http.Request, share db.ShareLink) bool {
+	if share.PasswordHash == nil {
+		return true
+	}
+	cookie, err := r.Cookie(shareUnlockCookieName(share))
+	return err == nil && hmac.Equal([]byte(cookie.Value), []byte(shareUnlockValue(share)))
+}
+
+// sharedAssets returns the assets a link gives access to.
+func sharedAssets(share db.ShareLink) ([]db.Asset, error) {
+	if share.AssetKey != "" {
+		if !db.KeyExists([]byte(share.AssetKey)) {
+			return nil, errors.New("asset no longer exists")
+		}
+		if _, ok := db.GetTrashEntry([]byte(share.AssetKey)); ok {
+			return nil, errors.New("asset is in the trash")
+		}
+		return []db.Asset{{AssetKey: share.AssetKey, DateTime: db.GetDateTime([]byte(share.AssetKey))}}, nil
+	}
+	owner, ok := db.GetUser(share.Owner)
+	if !ok {
+		return nil, errors.New("owner no longer exists")
+	}
+	return assetsInSet(owner, share.Set, dateRange{})
+}
+
+// withShare checks the token in the request path, and any password, before
+// passing the link and its assets on to h.
+func withShare(h func(http.ResponseWriter, *http.Request, db.ShareLink, []db.Asset)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		share, ok := shareFromToken(r.PathValue("token"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if !isShareUnlocked(r, share) {
+			http.Error(w, "password required", http.StatusUnauthorized)
+			return
+		}
+		assets, err := sharedAssets(share)
+		if err != nil {
+			requestLogger(r).Warn("Share link is broken", "share", share.ID, "err", err)
+			http.NotFound(w, r)
+			return
+		}
+		h(w, r, share, assets)
+	}
+}
+
+func isShared(assets []db.Asset, key string) bool {
+	for _, asset := range assets {
+		if asset.AssetKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+func sharePageHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := shareFromToken(r.PathValue("token")); !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, path.Join("./static", "share.html"))
+}
+
+func shareUnlockHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+	share, ok := shareFromToken(token)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	base := "/s/" + token + "/"
+	if share.PasswordHash != nil && bcrypt.CompareHashAndPassword(share.PasswordHash, []byte(r.FormValue("password"))) != nil {
+		requestLogger(r).Warn("Failed unlock of share link", "share", share.ID, "remote", r.RemoteAddr)
+		http.Redirect(w, r, base+"?failed=1", http.StatusSeeOther)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     shareUnlockCookieName(share),
+		Value:    shareUnlockValue(share),
+		Path:     base,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, base, http.StatusSeeOther)
+}
+
+func shareAssetInfosHandler(w http.ResponseWriter, r *http.Request, share db.ShareLink, assets []db.Asset) {
+	writeJSON(w, http.StatusOK, assets)
+}
+
+func shareThumbnailHandler(w http.ResponseWriter, r *http.Request, share db.ShareLink, assets []db.Asset) {
+	key := r.URL.Query().Get("id")
+	if !isShared(assets, key) {
+		http.NotFound(w, r)
+		return
+	}
+	serveThumbnail(w, r, key)
+}
+
+func shareAssetHandler(w http.ResponseWriter, r *http.Request, share db.ShareLink, assets []db.Asset) {
+	key := r.URL.Query().Get("id")
+	if !isShared(assets, key) {
+		http.NotFound(w, r)
+		return
+	}
+	if share.AllowDownload {
+		serveAsset(w, r, key)
+		return
+	}
+	serveRendition(w, r, key, renditionOptions{
+		Width:  sharePreviewSize,
+		Height: sharePreviewSize,
+		Fit:    "contain",
+		Format: "jpeg",
+	})
+}
+
+// shareLinkInfo is a share link as listed to its owner.
+type shareLinkInfo struct {
+	ID            string
+	Owner         string
+	AssetKey      string
+	Set           string
+	Expires       time.Time
+	HasPassword   bool
+	AllowDownload bool
+	Created       time.Time
+	URL           string
+}
+
+func newShareLinkInfo(s db.ShareLink) shareLinkInfo {
+	return shareLinkInfo{
+		ID:            s.ID,
+		Owner:         s.Owner,
+		AssetKey:      s.AssetKey,
+		Set:           s.Set,
+		Expires:       s.Expires,
+		HasPassword:   s.PasswordHash != nil,
+		AllowDownload: s.AllowDownload,
+		Created:       s.Created,
+		URL:           "/s/" + shareToken(s.ID) + "/",
+	}
+}
+
+type shareLinkRequest struct {
+	AssetKey      string
+	Set           string
+	Expires       string // YYYY-MM-DD or RFC 3339, empty for never
+	Password      string
+	AllowDownload bool
+}
+
+func createShareHandler(w http.ResponseWriter, r *http.Request) {
+	var req shareLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	user := currentUser(r)
+	if (req.AssetKey == "") == (req.Set == "") {
+		http.Error(w, "exactly one of AssetKey and Set is required", http.StatusBadRequest)
+		return
+	}
+	if req.AssetKey != "" && !db.KeyExists([]byte(req.AssetKey)) {
+		http.NotFound(w, r)
+		return
+	}
+	if req.Set != "" {
+		if _, err := assetsInSet(user, req.Set, dateRange{}); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+	expires, err := parseDateRange("", req.Expires)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		log.Fatal(err)
+	}
+	share := db.ShareLink{
+		ID:            hex.EncodeToString(id),
+		Owner:         user.Name,
+		AssetKey:      req.AssetKey,
+		Set:           req.Set,
+		Expires:       expires.To,
+		AllowDownload: req.AllowDownload,
+		Created:       time.Now(),
+	}
+	if req.Password != "" {
+		if share.PasswordHash, err = bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := db.PutShareLink(share); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newShareLinkInfo(share))
+}
+
+// getSharesHandler lists the caller's active links, or everyone's for an
+// admin passing ?all=1.
+func getSharesHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	owner := user.Name
+	if user.IsAdmin && r.URL.Query().Get("all") == "1" {
+		owner = ""
+	}
+	shares := []shareLinkInfo{}
+	for _, s := range db.GetShareLinks(owner) {
+		shares = append(shares, newShareLinkInfo(s))
+	}
+	writeJSON(w, http.StatusOK, shares)
+}
+
+func deleteShareHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	share, err := db.GetShareLink(r.PathValue("id"))
+	if err != nil || (share.Owner != user.Name && !user.IsAdmin) {
+		http.NotFound(w, r)
+		return
+	}
+	if err := db.DeleteShareLink(share.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
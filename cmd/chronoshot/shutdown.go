@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"chronoshot/pkg/db"
+)
+
+// How long in-flight requests get to finish once shutdown begins.
+const shutdownTimeout = 30 * time.Second
+
+// stopping is closed when a shutdown signal arrives, after which no new
+// indexing or job work is started.
+var stopping = make(chan struct{})
+
+var errStopped = errors.New("stopped by shutdown")
+
+func isStopping() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// tracker counts goroutines that use the database, so that shutdown can wait
+// for them before closing it. Once closed it starts no more.
+type tracker struct {
+	mu     sync.Mutex
+	wg     sync.WaitGroup
+	closed bool
+}
+
+// Add counts one more goroutine, unless shutdown is already waiting.
+func (t *tracker) Add() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *tracker) Done() {
+	t.wg.Done()
+}
+
+// Go runs f in a counted goroutine, unless shutdown has begun.
+func (t *tracker) Go(f func()) bool {
+	if isStopping() || !t.Add() {
+		return false
+	}
+	go func() {
+		defer t.Done()
+		f()
+	}()
+	return true
+}
+
+// Close refuses any more goroutines and waits for those running.
+func (t *tracker) Close() {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+	t.wg.Wait()
+}
+
+// background counts the goroutines started outside requests and jobs, such
+// as those handling changed files and the periodic clean ups.
+var background tracker
+
+// handleSignals closes stopping on SIGINT or SIGTERM. A second signal exits
+// immediately, for when a clean shutdown is taking too long.
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	slog.Info("Shutting down", "signal", sig.String())
+	close(stopping)
+	sig = <-signals
+	slog.Warn("Exiting without finishing writes", "signal", sig.String())
+	os.Exit(1)
+}
+
+// shutdown lets in-flight requests, background work, indexing and jobs
+// finish, then flushes pending writes and closes the database. The watcher
+// has already stopped by the time it is called.
+func shutdown(servers []*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("Error shutting down web server", "err", err)
+		}
+	}
+
+	// Background work may be waiting for a slot, so goes first.
+	background.Close()
+	// Taking every slot waits for the workers holding them.
+	for i := 0; i < cap(rateLimiter); i++ {
+		rateLimiter <- true
+	}
+	runningJobs.Close()
+
+	db.Close()
+	slog.Info("Shutdown complete")
+}
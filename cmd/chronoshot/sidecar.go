@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"chronoshot/pkg/db"
+)
+
+var xmpUser = flag.String("xmp-user", "", "user whose ratings and favourites are read from, and written to, XMP sidecars")
+var xmpWrite = flag.Bool("xmp-write", false, "write tags, captions and -xmp-user's ratings and favourites back to XMP sidecars")
+
+// sidecarPaths returns where the XMP sidecar for path may be: "photo.jpg.xmp"
+// as darktable and digiKam write them, or "photo.xmp" as Lightroom does.
+func sidecarPaths(path string) []string {
+	return []string{
+		path + ".xmp",
+		strings.TrimSuffix(path, filepath.Ext(path)) + ".xmp",
+	}
+}
+
+// findSidecar returns the path of an existing sidecar for path.
+func findSidecar(path string) (string, bool) {
+	for _, p := range sidecarPaths(path) {
+		if _, err := os.Stat(p); err == nil {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// applyXMP sets the metadata that comes from XMP.
+func applyXMP(meta *db.AssetMeta, x xmpMeta) {
+	meta.Caption = x.Caption
+	meta.Description = x.Description
+	meta.Keywords = x.Keywords
+	meta.Rating = x.Rating
+	meta.Label = x.Label
+	meta.Favourite = x.Favourite
+	meta.City = x.City
+	meta.State = x.State
+	meta.Country = x.Country
+	meta.Location = x.Location
+}
+
+// applySidecarUser gives -xmp-user the rating and favourite read from a
+// sidecar, where they have changed from old.
+func applySidecarUser(keyHash []byte, old db.AssetMeta, meta db.AssetMeta) {
+	if *xmpUser == "" {
+		return
+	}
+	if meta.Rating != old.Rating {
+		db.PutRating(*xmpUser, keyHash, max(0, meta.Rating))
+	}
+	if meta.Favourite != old.Favourite {
+		db.PutSelection(*xmpUser, keyHash, meta.Favourite)
+	}
+}
+
+// processSidecar reads a sidecar that has changed into the metadata of its
+// photo.
+func processSidecar(path string) {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	candidates := []string{base}
+	for _, ext := range []string{".jpg", ".jpeg", ".JPG", ".JPEG"} {
+		candidates = append(candidates, base+ext)
+	}
+	for _, photo := range candidates {
+		keyHash, ok := db.GetAssetKeyForPath([]byte(photo))
+		if !ok {
+			continue
+		}
+		b, err := os.ReadFile(photo)
+		if err != nil {
+			slog.Error("Could not read metadata", "path", photo, "err", err)
+			return
+		}
+		meta := readMeta(photo, b)
+		old, err := db.PutAssetMeta(keyHash, meta, true)
+		if err != nil {
+			slog.Error("Could not store metadata", "path", photo, "err", err)
+			return
+		}
+		applySidecarUser(keyHash, old, meta)
+		slog.Info("Read sidecar", "path", path)
+		return
+	}
+}
+
+// Sidecars waiting to be written, by asset key. Each is counted in
+// runningJobs so that shutdown waits for them, and none are queued once it
+// has begun.
+var sidecarWrites = make(chan string, 1000)
+
+// queueSidecarWrites writes the sidecars for keys in the background, if
+// -xmp-write is set.
+func queueSidecarWrites(keys ...string) {
+	if !*xmpWrite {
+		return
+	}
+	for _, key := range keys {
+		if isStopping() || !runningJobs.Add() {
+			slog.Warn("Not writing sidecar while shutting down", "key", key)
+			continue
+		}
+		sidecarWrites <- key
+	}
+}
+
+// queueUserSidecarWrites is queueSidecarWrites for a change to userName's
+// ratings or favourites, which only matter for -xmp-user.
+func queueUserSidecarWrites(userName string, keys ...string) {
+	if userName == *xmpUser {
+		queueSidecarWrites(keys...)
+	}
+}
+
+func sidecarWriter() {
+	for key := range sidecarWrites {
+		if err := writeSidecar([]byte(key)); err != nil {
+			slog.Error("Could not write sidecar", "key", key, "err", err)
+		}
+		runningJobs.Done()
+	}
+}
+
+// isRejected reports whether an XMP sidecar rates its photo as rejected.
+func isRejected(sidecar []byte) bool {
+	if len(sidecar) == 0 {
+		return false
+	}
+	x, err := readXMP(sidecar)
+	return err == nil && x.Rating < 0
+}
+
+// writeSidecar updates the sidecar of an asset, creating it if need be,
+// keeping whatever other tools have written there.
+func writeSidecar(keyHash []byte) error {
+	// Ratings and favourites are stored in the background.
+	db.Sync()
+	if !db.KeyExists(keyHash) {
+		return db.ErrAssetNotFound
+	}
+
+	path := string(db.GetAssetPath(keyHash))
+	target, ok := findSidecar(path)
+	if !ok {
+		target = sidecarPaths(path)[0]
+	}
+	existing, err := os.ReadFile(target)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	caption, err := db.GetAssetCaption(keyHash)
+	if err != nil {
+		return err
+	}
+	tags := db.GetAssetTags(keyHash)
+	props := xmpProps{
+		Caption:     &caption.Caption,
+		Description: &caption.Description,
+		Keywords:    &tags,
+	}
+	if *xmpUser != "" {
+		rating := db.GetRating(*xmpUser, keyHash)
+		favourite := db.GetIsSelected(*xmpUser, keyHash)
+		// Ratings here cannot be rejects, which are stored as no rating, so
+		// a reject in the sidecar is kept until the photo is rated.
+		if rating != 0 || !isRejected(existing) {
+			props.Rating = &rating
+		}
+		props.Favourite = &favourite
+	}
+	updated, err := updateXMP(existing, props)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(updated, existing) {
+		return nil
+	}
+
+	// Write by renaming so that the watcher does not read it straight back.
+	part := target + ".part"
+	if err := os.WriteFile(part, updated, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(part, target); err != nil {
+		os.Remove(part)
+		return err
+	}
+
+	// Record what was written as read from the file, so that a later change
+	// made by another tool is compared against it.
+	x, err := readXMP(updated)
+	if err != nil {
+		return err
+	}
+	meta, err := db.GetAssetMeta(keyHash)
+	if err != nil {
+		return err
+	}
+	applyXMP(&meta, x)
+	_, err = db.PutAssetMeta(keyHash, meta, true)
+	return err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"chronoshot/pkg/db"
+	"chronoshot/pkg/db/dbtest"
+)
+
+const rejectedSidecar = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmp:Rating="-1"/>
+ </rdf:RDF>
+</x:xmpmeta>
+`
+
+// readSidecar reads back the sidecar written for the photo at path.
+func readSidecar(t *testing.T, path string) xmpMeta {
+	t.Helper()
+	b, err := os.ReadFile(path + ".xmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := readXMP(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x
+}
+
+func TestWriteSidecarKeepsReject(t *testing.T) {
+	dbtest.Open(t)
+	saved := *xmpUser
+	*xmpUser = "alice"
+	t.Cleanup(func() { *xmpUser = saved })
+
+	path := filepath.Join(t.TempDir(), "a.jpg")
+	if err := os.WriteFile(path+".xmp", []byte(rejectedSidecar), 0644); err != nil {
+		t.Fatal(err)
+	}
+	key := dbtest.PutAsset(path, time.Now(), db.AssetMeta{Rating: -1})
+
+	if err := db.PutAssetTag(key, "beach", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSidecar(key); err != nil {
+		t.Fatal(err)
+	}
+	if x := readSidecar(t, path); x.Rating != -1 || !slices.Equal(x.Keywords, []string{"beach"}) {
+		t.Errorf("after tagging: rating %d and keywords %q, want -1 and beach", x.Rating, x.Keywords)
+	}
+
+	// Rating the photo replaces the reject.
+	db.PutRating("alice", key, 3)
+	if err := writeSidecar(key); err != nil {
+		t.Fatal(err)
+	}
+	if x := readSidecar(t, path); x.Rating != 3 {
+		t.Errorf("after rating: rating %d, want 3", x.Rating)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"chronoshot/pkg/db"
+)
+
+// smartAlbumInfo is a smart album along with the set name to view it by.
+type smartAlbumInfo struct {
+	db.SmartAlbum
+	Set string // name to pass as ?set= to getAssetInfos and getSetArchive
+}
+
+func newSmartAlbumInfo(a db.SmartAlbum) smartAlbumInfo {
+	return smartAlbumInfo{a, "smart:" + a.ID}
+}
+
+type smartAlbumRequest struct {
+	Name  string
+	Query string
+}
+
+// decodeSmartAlbumRequest reads a smart album definition, checking that its
+// query can be run.
+func decodeSmartAlbumRequest(w http.ResponseWriter, r *http.Request) (smartAlbumRequest, bool) {
+	var req smartAlbumRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		http.Error(w, "album name required", http.StatusBadRequest)
+		return req, false
+	}
+	defer r.Body.Close()
+
+	if _, err := parseSearchQuery(req.Query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+func getSmartAlbumsHandler(w http.ResponseWriter, r *http.Request) {
+	albums := []smartAlbumInfo{}
+	for _, a := range db.GetSmartAlbums(currentUser(r).Name) {
+		albums = append(albums, newSmartAlbumInfo(a))
+	}
+	writeJSON(w, http.StatusOK, albums)
+}
+
+func createSmartAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeSmartAlbumRequest(w, r)
+	if !ok {
+		return
+	}
+	album, err := db.CreateSmartAlbum(currentUser(r).Name, req.Name, req.Query)
+	if err != nil {
+		writeAlbumError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newSmartAlbumInfo(album))
+}
+
+func updateSmartAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeSmartAlbumRequest(w, r)
+	if !ok {
+		return
+	}
+	album, err := db.UpdateSmartAlbum(currentUser(r).Name, r.PathValue("id"), func(a *db.SmartAlbum) error {
+		a.Name = req.Name
+		a.Query = req.Query
+		return nil
+	})
+	if err != nil {
+		writeAlbumError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSmartAlbumInfo(album))
+}
+
+func deleteSmartAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	if err := db.DeleteSmartAlbum(currentUser(r).Name, r.PathValue("id")); err != nil {
+		writeAlbumError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
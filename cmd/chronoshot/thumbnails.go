@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"chronoshot/pkg/db"
+
+	"github.com/disintegration/imaging"
+)
+
+// Thumbnail size used when a client does not ask for one, matching the grid
+// in index.html.
+const defaultThumbnailSize = 200
+
+// sizeList is a flag.Value holding a comma separated list of pixel sizes,
+// kept in ascending order.
+type sizeList []int
+
+func (l *sizeList) String() string {
+	s := make([]string, len(*l))
+	for i, size := range *l {
+		s[i] = strconv.Itoa(size)
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *sizeList) Set(value string) error {
+	var sizes []int
+	for _, s := range strings.Split(value, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || size <= 0 {
+			return fmt.Errorf("invalid size %q", s)
+		}
+		sizes = append(sizes, size)
+	}
+	sort.Ints(sizes)
+	*l = sizes
+	return nil
+}
+
+var thumbnailSizes = sizeList{128, 256, 512, 1024}
+var thumbnailQuality = flag.Int("thumbnail-quality", 80, "JPEG quality of thumbnails")
+
+func init() {
+	flag.Var(&thumbnailSizes, "thumbnail-sizes", "comma separated thumbnail sizes in pixels")
+}
+
+// makeThumbnails produces a square JPEG thumbnail of img for each size.
+func makeThumbnails(img image.Image, sizes []int) (map[int][]byte, error) {
+	start := time.Now()
+	defer func() { thumbnailDuration.Observe(time.Since(start).Seconds()) }()
+
+	sorted := append([]int(nil), sizes...)
+	sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+
+	// Work down from the largest size, resizing each thumbnail from the
+	// previous one rather than from the full image.
+	thumbnails := make(map[int][]byte, len(sorted))
+	src := img
+	for _, size := range sorted {
+		thumbnail := imaging.Thumbnail(src, size, size, imaging.Lanczos)
+		src = thumbnail
+
+		buf := new(bytes.Buffer)
+		if err := jpeg.Encode(buf, thumbnail, &jpeg.Options{Quality: *thumbnailQuality}); err != nil {
+			return nil, err
+		}
+		thumbnails[size] = buf.Bytes()
+	}
+	return thumbnails, nil
+}
+
+// generateThumbnails reads the photo at path and makes thumbnails of the
+// given sizes, turned by rotation if it is not nil.
+func generateThumbnails(path string, rotation *db.Rotation, sizes []int) (map[int][]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	_, orientation := getExifDateTime(b)
+
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return makeThumbnails(orientAsset(img, orientation, rotation), sizes)
+}
+
+// fillMissingThumbnails generates any configured thumbnail sizes that are not
+// yet stored, e.g. for assets indexed before the sizes were changed.
+func fillMissingThumbnails() {
+	missing := db.GetMissingThumbnails(thumbnailSizes)
+	if len(missing) == 0 {
+		return
+	}
+	slog.Info("Generating missing thumbnails", "assets", len(missing))
+
+	var wg sync.WaitGroup
+	for key, sizes := range missing {
+		if isStopping() {
+			break
+		}
+		rateLimiter <- true
+		wg.Add(1)
+		go func(key string, sizes []int) {
+			defer func() { <-rateLimiter; wg.Done() }()
+			path := string(db.GetAssetPath([]byte(key)))
+			thumbnails, err := generateThumbnails(path, assetRotation(key), sizes)
+			if err != nil {
+				slog.Error("Could not generate thumbnails", "path", path, "err", err)
+				return
+			}
+			db.PutThumbnails([]byte(key), thumbnails)
+		}(key, sizes)
+	}
+	wg.Wait()
+
+	slog.Info("Finished generating missing thumbnails")
+}
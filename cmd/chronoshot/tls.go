@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var listenAddr = flag.String("listen", ":8080", "address to serve on")
+var tlsCertFile = flag.String("tls-cert", "", "PEM certificate file; serves HTTPS when set with -tls-key")
+var tlsKeyFile = flag.String("tls-key", "", "PEM private key file")
+var tlsSelfSigned = flag.Bool("tls-self-signed", false, "generate a self-signed certificate at -tls-cert and -tls-key if they do not exist")
+var httpRedirectAddr = flag.String("http-redirect", "", "also serve plain HTTP on this address, redirecting to HTTPS, e.g. :80")
+var hsts = flag.Bool("hsts", false, "send Strict-Transport-Security on HTTPS responses")
+
+// How often a handshake may check the certificate files for changes.
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves the certificate in certFile and keyFile, picking up
+// changes to them, e.g. after a renewal, without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex     sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) load() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// GetCertificate is for tls.Config. If the files have changed but cannot be
+// loaded, e.g. mid-way through being replaced, the previous certificate is
+// served until the next check.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if time.Since(c.lastCheck) >= certCheckInterval {
+		c.lastCheck = time.Now()
+		if modTime, err := c.filesModTime(); err == nil && !modTime.Equal(c.modTime) {
+			if err := c.load(); err != nil {
+				slog.Error("Unable to reload TLS certificate", "err", err)
+			} else {
+				slog.Info("Reloaded TLS certificate", "path", c.certFile)
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+// writeSelfSignedCert creates a certificate for this machine's host name and
+// addresses, for use on a LAN where browsers will be told to trust it.
+func writeSelfSignedCert(certFile string, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"chronoshot"}, CommonName: "chronoshot"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// tlsConfig returns nil when HTTPS is not configured.
+func tlsConfig() (*tls.Config, error) {
+	if *tlsCertFile == "" && *tlsKeyFile == "" {
+		if *tlsSelfSigned || *httpRedirectAddr != "" || *hsts {
+			return nil, errors.New("-tls-self-signed, -http-redirect and -hsts need -tls-cert and -tls-key")
+		}
+		return nil, nil
+	}
+	if *tlsCertFile == "" || *tlsKeyFile == "" {
+		return nil, errors.New("-tls-cert and -tls-key must be given together")
+	}
+
+	if *tlsSelfSigned {
+		_, certErr := os.Stat(*tlsCertFile)
+		_, keyErr := os.Stat(*tlsKeyFile)
+		if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+			if err := writeSelfSignedCert(*tlsCertFile, *tlsKeyFile); err != nil {
+				return nil, fmt.Errorf("unable to create self-signed certificate: %v", err)
+			}
+			slog.Info("Created self-signed certificate", "path", *tlsCertFile)
+		}
+	}
+
+	certs, err := newCertReloader(*tlsCertFile, *tlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}, nil
+}
+
+// withHSTS tells browsers to only use HTTPS for the next year.
+func withHSTS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", "max-age=31536000")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same path on the HTTPS
+// listener.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(*listenAddr); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// serve starts the web server, over HTTPS if it is configured, returning the
+// servers started so they can be shut down.
+func serve(handler http.Handler) []*http.Server {
+	config, err := tlsConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config == nil {
+		server := &http.Server{Addr: *listenAddr, Handler: handler}
+		go listen(server.ListenAndServe)
+		return []*http.Server{server}
+	}
+
+	if *hsts {
+		handler = withHSTS(handler)
+	}
+	server := &http.Server{Addr: *listenAddr, Handler: handler, TLSConfig: config}
+	go listen(func() error { return server.ListenAndServeTLS("", "") })
+	if *httpRedirectAddr == "" {
+		return []*http.Server{server}
+	}
+	redirect := &http.Server{Addr: *httpRedirectAddr, Handler: http.HandlerFunc(redirectToHTTPS)}
+	go listen(redirect.ListenAndServe)
+	return []*http.Server{server, redirect}
+}
+
+func listen(listenAndServe func() error) {
+	if err := listenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
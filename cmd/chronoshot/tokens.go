@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"chronoshot/pkg/db"
+)
+
+// apiTokenInfo is an API token as listed to its owner, without the token
+// itself, which is only returned when it is created.
+type apiTokenInfo struct {
+	ID       string
+	Name     string
+	Scopes   []string
+	Created  time.Time
+	Expires  time.Time
+	LastUsed time.Time
+	Expired  bool
+	Token    string `json:",omitempty"`
+}
+
+func newAPITokenInfo(t db.APIToken) apiTokenInfo {
+	return apiTokenInfo{
+		ID:       t.ID,
+		Name:     t.Name,
+		Scopes:   t.Scopes,
+		Created:  t.Created,
+		Expires:  t.Expires,
+		LastUsed: t.LastUsed,
+		Expired:  t.Expired(),
+	}
+}
+
+type apiTokenRequest struct {
+	Name    string
+	Scopes  []string // any of "read", "write" and "admin"
+	Expires string   // YYYY-MM-DD or RFC 3339, empty for never
+}
+
+func createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req apiTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	user := currentUser(r)
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "at least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		switch scope {
+		case db.ScopeRead, db.ScopeWrite:
+		case db.ScopeAdmin:
+			if !user.IsAdmin {
+				http.Error(w, "only admins can create admin tokens", http.StatusForbidden)
+				return
+			}
+		default:
+			http.Error(w, "unknown scope "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+	expires, err := parseDateRange("", req.Expires)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		log.Fatal(err)
+	}
+	value := newToken()
+	token := db.APIToken{
+		ID:       hex.EncodeToString(id),
+		UserName: user.Name,
+		Name:     req.Name,
+		Scopes:   req.Scopes,
+		Created:  time.Now(),
+		Expires:  expires.To,
+	}
+	if err := db.PutAPIToken(hashToken(value), token); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	requestLogger(r).Info("Created API token", "token", token.ID, "scopes", token.Scopes)
+
+	info := newAPITokenInfo(token)
+	info.Token = value
+	writeJSON(w, http.StatusCreated, info)
+}
+
+func getTokensHandler(w http.ResponseWriter, r *http.Request) {
+	tokens := []apiTokenInfo{}
+	for _, t := range db.GetAPITokens(currentUser(r).Name) {
+		tokens = append(tokens, newAPITokenInfo(t))
+	}
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+func deleteTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if err := db.DeleteAPIToken(currentUser(r).Name, r.PathValue("id")); err != nil {
+		if err == db.ErrTokenNotFound {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"chronoshot/pkg/db"
+)
+
+var trashDir = flag.String("trash-dir", "", "move the files of trashed assets to this folder until they are restored or purged")
+var trashDays = flag.Int("trash-days", 30, "purge assets that have been in the trash this many days, or never if 0")
+
+// How often the trash is checked for assets to purge.
+const trashPurgeInterval = time.Hour
+
+var errFileExists = errors.New("a file is already where the asset would be restored")
+
+// setupTrash creates the trash folder, if there is one.
+func setupTrash() {
+	if *trashDir == "" {
+		return
+	}
+	dir, err := filepath.Abs(*trashDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	*trashDir = dir
+}
+
+// inTrashDir reports whether path is in the trash folder, which is never
+// indexed.
+func inTrashDir(path string) bool {
+	if *trashDir == "" {
+		return false
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	return abs == *trashDir || strings.HasPrefix(abs, *trashDir+string(filepath.Separator))
+}
+
+// trashAsset puts the asset with key in the trash, moving the photo and any
+// sidecar to the trash folder if there is one.
+func trashAsset(key string, userName string) error {
+	if _, ok := db.GetTrashEntry([]byte(key)); ok {
+		return nil
+	}
+	if !db.KeyExists([]byte(key)) {
+		return db.ErrAssetNotFound
+	}
+	entry := db.TrashEntry{AssetKey: key, Deleted: time.Now(), DeletedBy: userName}
+	if *trashDir != "" {
+		path := string(db.GetAssetPath([]byte(key)))
+		files := []string{path}
+		if sidecar, ok := findSidecar(path); ok {
+			files = append(files, sidecar)
+		}
+		entry.Moved = make(map[string]string)
+		for _, file := range files {
+			// Prefixed with the key so that the sidecar still goes with
+			// the photo, and photos from different folders do not clash.
+			moved := filepath.Join(*trashDir, key+"-"+filepath.Base(file))
+			if err := os.Rename(file, moved); err != nil {
+				putBack(key, entry.Moved)
+				return err
+			}
+			entry.Moved[file] = moved
+		}
+	}
+	if err := db.PutTrash(entry); err != nil {
+		putBack(key, entry.Moved)
+		return err
+	}
+	return nil
+}
+
+// putBack undoes the moves to the trash folder of an asset that could not be
+// trashed. Failures are only logged, as the asset's own error matters more.
+func putBack(key string, moved map[string]string) {
+	if err := restoreFiles(moved); err != nil {
+		slog.Error("Could not put files back after failing to trash them", "key", key, "files", moved, "err", err)
+	}
+}
+
+// restoreAsset takes the asset with key out of the trash, moving its files
+// back to where they were.
+func restoreAsset(key string) error {
+	entry, ok := db.GetTrashEntry([]byte(key))
+	if !ok {
+		return db.ErrNotInTrash
+	}
+	if err := restoreFiles(entry.Moved); err != nil {
+		return err
+	}
+	return db.RestoreFromTrash([]byte(key))
+}
+
+// restoreFiles moves files from the trash folder back to where they were,
+// unless something has taken the place of any of them. If one cannot be
+// moved, those already moved go back to the trash folder.
+func restoreFiles(moved map[string]string) error {
+	for file := range moved {
+		if _, err := os.Stat(file); err == nil {
+			return errFileExists
+		}
+	}
+	restored := make(map[string]string)
+	for file, trashed := range moved {
+		if err := os.Rename(trashed, file); err != nil {
+			for file, trashed := range restored {
+				if err := os.Rename(file, trashed); err != nil {
+					slog.Error("Could not move a restored file back to the trash", "path", file, "err", err)
+				}
+			}
+			return err
+		}
+		restored[file] = trashed
+	}
+	return nil
+}
+
+// purgeAsset removes an asset in the trash from the database, and deletes
+// any of its files in the trash folder.
+func purgeAsset(entry db.TrashEntry) error {
+	if err := db.PurgeAsset([]byte(entry.AssetKey)); err != nil {
+		return err
+	}
+	for _, trashed := range entry.Moved {
+		if err := os.Remove(trashed); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// startPurge purges entries from the trash in the background.
+func startPurge(entries []db.TrashEntry) (*job, error) {
+	j, err := newJob("purge")
+	if err != nil {
+		return nil, err
+	}
+	j.SetTotal(len(entries))
+
+	go func() {
+		// Let favourites and ratings still being stored land before
+		// removing them.
+		db.Sync()
+		var err error
+		for _, entry := range entries {
+			if isStopping() {
+				err = errStopped
+				break
+			}
+			if err := purgeAsset(entry); err != nil {
+				j.Fail(entry.AssetKey, err)
+				continue
+			}
+			j.Succeed()
+		}
+		j.Finish(err)
+	}()
+
+	return j, nil
+}
+
+// purgeDate returns when an entry will be purged, or the zero time if the
+// trash is never purged.
+func purgeDate(entry db.TrashEntry) time.Time {
+	if *trashDays <= 0 {
+		return time.Time{}
+	}
+	return entry.Deleted.AddDate(0, 0, *trashDays)
+}
+
+// purgeExpiredTrash purges everything that has been in the trash longer
+// than -trash-days, every trashPurgeInterval until shutdown.
+func purgeExpiredTrash() {
+	for {
+		now := time.Now()
+		var expired []db.TrashEntry
+		for _, entry := range db.GetTrash() {
+			if due := purgeDate(entry); !due.IsZero() && due.Before(now) {
+				expired = append(expired, entry)
+			}
+		}
+		if len(expired) > 0 {
+			if j, err := startPurge(expired); err == nil {
+				slog.Info("Purging trash", "assets", len(expired), "job", j.Progress().ID)
+			}
+		}
+
+		select {
+		case <-time.After(trashPurgeInterval):
+		case <-stopping:
+			return
+		}
+	}
+}
+
+// apiTrashHandler puts the asset in the trash on PUT and restores it on
+// DELETE.
+func apiTrashHandler(w http.ResponseWriter, r *http.Request, key string) {
+	var err error
+	if r.Method == "PUT" {
+		err = trashAsset(key, currentUser(r).Name)
+	} else {
+		err = restoreAsset(key)
+	}
+	switch {
+	case err == db.ErrAssetNotFound || err == db.ErrNotInTrash:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err == errFileExists:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		requestLogger(r).Error("Could not change trash", "key", key, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// trashItem is an entry in the trash as listed over HTTP.
+type trashItem struct {
+	db.TrashEntry
+	DateTime time.Time
+	Purge    *time.Time `json:",omitempty"` // when it will be purged, if ever
+}
+
+func apiTrashListHandler(w http.ResponseWriter, r *http.Request) {
+	items := []trashItem{}
+	for _, entry := range db.GetTrash() {
+		item := trashItem{TrashEntry: entry, DateTime: db.GetDateTime([]byte(entry.AssetKey))}
+		if due := purgeDate(entry); !due.IsZero() {
+			item.Purge = &due
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, k int) bool { return items[i].Deleted.After(items[k].Deleted) })
+	writeJSON(w, http.StatusOK, items)
+}
+
+// purgeRequest selects assets in the trash to purge now. With no keys the
+// whole trash is emptied.
+type purgeRequest struct {
+	AssetKeys []string
+}
+
+func purgeHandler(w http.ResponseWriter, r *http.Request) {
+	var req purgeRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	defer r.Body.Close()
+
+	entries := db.GetTrash()
+	if len(req.AssetKeys) > 0 {
+		entries = nil
+		for _, key := range req.AssetKeys {
+			entry, ok := db.GetTrashEntry([]byte(key))
+			if !ok {
+				http.Error(w, fmt.Sprintf("asset %s is not in the trash", key), http.StatusBadRequest)
+				return
+			}
+			entries = append(entries, entry)
+		}
+	}
+	j, err := startPurge(entries)
+	if err != nil {
+		http.Error(w, err.Error(), jobErrorStatus(err))
+		return
+	}
+	requestLogger(r).Info("Purging trash", "assets", len(entries), "job", j.Progress().ID)
+	writeJSON(w, http.StatusAccepted, j.Progress())
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// trashedFiles creates the trashed side of each file in a temporary
+// directory, returning a map like TrashEntry.Moved.
+func trashedFiles(t *testing.T, names ...string) map[string]string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "trash"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	moved := make(map[string]string)
+	for _, name := range names {
+		trashed := filepath.Join(dir, "trash", name)
+		if err := os.WriteFile(trashed, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		moved[filepath.Join(dir, name)] = trashed
+	}
+	return moved
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestRestoreFiles(t *testing.T) {
+	moved := trashedFiles(t, "a.jpg", "a.jpg.xmp")
+	if err := restoreFiles(moved); err != nil {
+		t.Fatal(err)
+	}
+	for file, trashed := range moved {
+		if !exists(file) || exists(trashed) {
+			t.Errorf("%s was not restored", file)
+		}
+	}
+}
+
+func TestRestoreFilesWhenTaken(t *testing.T) {
+	moved := trashedFiles(t, "a.jpg", "a.jpg.xmp")
+	for file := range moved {
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+	if err := restoreFiles(moved); err != errFileExists {
+		t.Fatalf("got %v, want errFileExists", err)
+	}
+	for _, trashed := range moved {
+		if !exists(trashed) {
+			t.Errorf("%s was moved although the restore failed", trashed)
+		}
+	}
+}
+
+func TestRestoreFilesRollsBack(t *testing.T) {
+	// Map order varies, so try a few times to fail after moving some.
+	for range 10 {
+		moved := trashedFiles(t, "a.jpg", "a.jpg.xmp", "a.xmp")
+		var missing string
+		for _, trashed := range moved {
+			missing = trashed
+			break
+		}
+		if err := os.Remove(missing); err != nil {
+			t.Fatal(err)
+		}
+		if err := restoreFiles(moved); err == nil {
+			t.Fatal("no error for a missing file")
+		}
+		for file, trashed := range moved {
+			if exists(file) {
+				t.Errorf("%s was left restored", file)
+			}
+			if trashed != missing && !exists(trashed) {
+				t.Errorf("%s was not put back in the trash", trashed)
+			}
+		}
+	}
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"chronoshot/pkg/db"
+)
+
+var uploadDir = flag.String("upload-dir", "inbox", "folder under the photo directory that uploaded photos are put in, by date taken")
+var uploadMaxSize = flag.Int64("upload-max-size", 200, "largest photo that can be uploaded in MB, or no limit if 0")
+
+// Unfinished uploads are kept in this folder under the inbox, and are
+// removed once they have not been touched for uploadExpiry.
+const (
+	uploadsPartialDir = ".uploads"
+	uploadExpiry      = 24 * time.Hour
+)
+
+// The version of the tus resumable upload protocol that is spoken.
+const tusVersion = "1.0.0"
+
+// uploadRoot is the inbox, joined to the photo directory as it was given so
+// that uploaded photos are indexed under the same paths as when walked.
+var uploadRoot string
+
+var (
+	errNotJPEG        = errors.New("only JPEG photos can be uploaded")
+	errUploadTooLarge = errors.New("photo is larger than -upload-max-size")
+	errUploadBusy     = errors.New("upload is already being written to")
+)
+
+// pendingHashes holds the content hashes of uploads being indexed, so that
+// the same photo sent twice at once is only kept once while different photos
+// are indexed side by side.
+var pendingHashes = struct {
+	sync.Mutex
+	m map[string]*sync.WaitGroup
+}{m: make(map[string]*sync.WaitGroup)}
+
+// reserveHash returns the asset already holding hash, or reserves hash for
+// the caller, who must call release once the photo is indexed or dropped.
+// An upload of the same photo already in progress is waited for.
+func reserveHash(hash string) (key []byte, release func()) {
+	for {
+		pendingHashes.Lock()
+		if pending, ok := pendingHashes.m[hash]; ok {
+			pendingHashes.Unlock()
+			pending.Wait()
+			continue
+		}
+		if key, ok := db.GetAssetKeyForContent(hash); ok {
+			pendingHashes.Unlock()
+			return key, nil
+		}
+		pending := new(sync.WaitGroup)
+		pending.Add(1)
+		pendingHashes.m[hash] = pending
+		pendingHashes.Unlock()
+		return nil, func() {
+			pendingHashes.Lock()
+			delete(pendingHashes.m, hash)
+			pendingHashes.Unlock()
+			pending.Done()
+		}
+	}
+}
+
+// setupUploads creates the inbox under photoDir.
+func setupUploads(photoDir string) {
+	if !filepath.IsLocal(*uploadDir) {
+		log.Fatalf("-upload-dir %s must be a folder under the photo directory", *uploadDir)
+	}
+	uploadRoot = filepath.Join(photoDir, *uploadDir)
+	if err := os.MkdirAll(filepath.Join(uploadRoot, uploadsPartialDir), 0755); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// uploadResult is what became of an uploaded photo.
+type uploadResult struct {
+	AssetKey  string
+	Name      string // as uploaded
+	Duplicate bool   // the photo was already there, and the upload was dropped
+}
+
+// addUpload moves the uploaded file at tmp into the inbox and indexes it,
+// unless the same photo is already there. tmp is gone afterwards either way.
+func addUpload(tmp string, name string) (uploadResult, error) {
+	result := uploadResult{Name: name}
+	b, err := os.ReadFile(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return result, err
+	}
+	if http.DetectContentType(b) != "image/jpeg" {
+		os.Remove(tmp)
+		return result, errNotJPEG
+	}
+	sum := sha256.Sum256(b)
+
+	key, release := reserveHash(hex.EncodeToString(sum[:]))
+	if release == nil {
+		os.Remove(tmp)
+		result.AssetKey = string(key)
+		result.Duplicate = true
+		return result, nil
+	}
+	defer release()
+
+	dateTime, _ := getExifDateTime(b)
+	dest, err := moveUpload(tmp, dateTime, name)
+	if err != nil {
+		os.Remove(tmp)
+		return result, err
+	}
+
+	rateLimiter <- true
+	key, err = indexPhoto(dest)
+	<-rateLimiter
+	if err == nil && key == nil {
+		err = errors.New("photo was not indexed")
+	}
+	if err != nil {
+		os.Remove(dest)
+		return result, err
+	}
+	db.Sync()
+	result.AssetKey = string(key)
+	return result, nil
+}
+
+// uploadPathMu stops two uploads with the same name taking the same free
+// path.
+var uploadPathMu sync.Mutex
+
+// moveUpload moves the uploaded file at tmp to a free path in the inbox, and
+// returns it.
+func moveUpload(tmp string, dateTime time.Time, name string) (string, error) {
+	if err := os.Chmod(tmp, 0644); err != nil {
+		return "", err
+	}
+	uploadPathMu.Lock()
+	defer uploadPathMu.Unlock()
+	dest, err := uploadPath(dateTime, name)
+	if err != nil {
+		return "", err
+	}
+	return dest, os.Rename(tmp, dest)
+}
+
+// uploadPath returns a free path in the inbox for a photo taken at dateTime,
+// in a folder for the day, or "undated" if it has no date.
+func uploadPath(dateTime time.Time, name string) (string, error) {
+	folder := "undated"
+	if !dateTime.IsZero() && !dateTime.Equal(time.Unix(0, 0)) {
+		folder = dateTime.Format("2006/01/02")
+	}
+	dir := filepath.Join(uploadRoot, filepath.FromSlash(folder))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	base := uploadName(name)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	for i := 1; ; i++ {
+		p := filepath.Join(dir, base)
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			return p, nil
+		} else if err != nil {
+			return "", err
+		}
+		base = fmt.Sprintf("%s-%d%s", stem, i, ext)
+	}
+}
+
+// uploadName makes the name a client gave a photo safe to use as a file
+// name, with an extension that gets it indexed.
+func uploadName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.TrimLeft(name, ".")
+	if name == "" || name == "/" {
+		name = "upload"
+	}
+	if ext := strings.ToLower(filepath.Ext(name)); ext != ".jpg" && ext != ".jpeg" {
+		name += ".jpg"
+	}
+	return name
+}
+
+// uploadLimit returns the most bytes a photo may have, or -1 for no limit.
+func uploadLimit() int64 {
+	if *uploadMaxSize <= 0 {
+		return -1
+	}
+	return *uploadMaxSize << 20
+}
+
+// receiveUpload copies r to a new file with the unfinished uploads, and
+// returns its path.
+func receiveUpload(r io.Reader) (string, error) {
+	f, err := os.CreateTemp(filepath.Join(uploadRoot, uploadsPartialDir), "multipart-*.part")
+	if err != nil {
+		return "", err
+	}
+	limit := uploadLimit()
+	if limit >= 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	n, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && limit >= 0 && n > limit {
+		err = errUploadTooLarge
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// writeUploadError responds with the status that fits an error from adding
+// an upload.
+func writeUploadError(w http.ResponseWriter, r *http.Request, name string, err error) {
+	switch err {
+	case errNotJPEG:
+		http.Error(w, fmt.Sprintf("%s: %v", name, err), http.StatusUnsupportedMediaType)
+	case errUploadTooLarge:
+		http.Error(w, fmt.Sprintf("%s: %v", name, err), http.StatusRequestEntityTooLarge)
+	default:
+		requestLogger(r).Error("Could not add upload", "name", name, "err", err)
+		http.Error(w, fmt.Sprintf("%s: %v", name, err), http.StatusInternalServerError)
+	}
+}
+
+// apiAddAssetsHandler adds the photos in the "file" parts of a multipart
+// form. Photos before one that fails are kept, and are recognised as
+// duplicates if the whole form is sent again.
+func apiAddAssetsHandler(w http.ResponseWriter, r *http.Request) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results := []uploadResult{}
+	status := http.StatusOK
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			continue
+		}
+		name := part.FileName()
+		tmp, err := receiveUpload(part)
+		if err != nil {
+			writeUploadError(w, r, name, err)
+			return
+		}
+		result, err := addUpload(tmp, name)
+		if err != nil {
+			writeUploadError(w, r, name, err)
+			return
+		}
+		requestLogger(r).Info("Uploaded photo", "name", name, "key", result.AssetKey, "duplicate", result.Duplicate)
+		if !result.Duplicate {
+			status = http.StatusCreated
+		}
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		http.Error(w, "no file to upload", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, status, results)
+}
+
+// upload is a resumable upload, stored as JSON beside the data received so
+// far so that it can be carried on with after a restart.
+type upload struct {
+	ID        string
+	User      string
+	Name      string
+	Length    int64
+	Offset    int64
+	Created   time.Time
+	AssetKey  string `json:",omitempty"` // once finished
+	Duplicate bool   `json:",omitempty"`
+}
+
+// uploadFile is where the data, with ext ".part", or the state, with ext
+// ".json", of an upload is kept.
+func uploadFile(id string, ext string) string {
+	return filepath.Join(uploadRoot, uploadsPartialDir, id+ext)
+}
+
+func saveUpload(u upload) error {
+	buf, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(uploadFile(u.ID, ".json"), buf, 0644)
+}
+
+// loadUpload returns the user's upload with id, with the offset of the data
+// received so far.
+func loadUpload(id string, userName string) (upload, bool) {
+	if _, err := base64.RawURLEncoding.DecodeString(id); err != nil || id == "" {
+		return upload{}, false
+	}
+	buf, err := os.ReadFile(uploadFile(id, ".json"))
+	if err != nil {
+		return upload{}, false
+	}
+	var u upload
+	if err := json.Unmarshal(buf, &u); err != nil || u.User != userName {
+		return upload{}, false
+	}
+	if u.AssetKey != "" {
+		u.Offset = u.Length
+		return u, true
+	}
+	info, err := os.Stat(uploadFile(id, ".part"))
+	if err != nil {
+		return upload{}, false
+	}
+	u.Offset = info.Size()
+	return u, true
+}
+
+func removeUpload(id string) {
+	os.Remove(uploadFile(id, ".part"))
+	os.Remove(uploadFile(id, ".json"))
+}
+
+// patching holds the uploads being written to, which tus clients only do
+// one request at a time.
+var patching = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+func startPatching(id string) bool {
+	patching.Lock()
+	defer patching.Unlock()
+	if patching.m[id] {
+		return false
+	}
+	patching.m[id] = true
+	return true
+}
+
+func stopPatching(id string) {
+	patching.Lock()
+	defer patching.Unlock()
+	delete(patching.m, id)
+}
+
+// withTus marks responses as tus and turns away other protocol versions.
+func withTus(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if v := r.Header.Get("Tus-Resumable"); v != "" && v != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			http.Error(w, "unsupported tus version "+v, http.StatusPreconditionFailed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func uploadOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,termination")
+	if limit := uploadLimit(); limit >= 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(limit, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseUploadMetadata reads the Upload-Metadata header, which is a comma
+// separated list of keys, each followed by a base64 value.
+func parseUploadMetadata(header string) map[string]string {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		if b, err := base64.StdEncoding.DecodeString(value); err == nil {
+			meta[key] = string(b)
+		}
+	}
+	return meta
+}
+
+// createUploadHandler starts a resumable upload of Upload-Length bytes.
+func createUploadHandler(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		http.Error(w, "Upload-Length is required", http.StatusBadRequest)
+		return
+	}
+	// An empty upload could never be finished by a PATCH, nor be a photo.
+	if length <= 0 {
+		http.Error(w, "Upload-Length must be more than 0", http.StatusBadRequest)
+		return
+	}
+	if limit := uploadLimit(); limit >= 0 && length > limit {
+		http.Error(w, errUploadTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	name := meta["filename"]
+	if name == "" {
+		name = meta["name"]
+	}
+
+	u := upload{
+		ID:      newToken(),
+		User:    currentUser(r).Name,
+		Name:    name,
+		Length:  length,
+		Created: time.Now(),
+	}
+	if err := os.WriteFile(uploadFile(u.ID, ".part"), nil, 0600); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := saveUpload(u); err != nil {
+		removeUpload(u.ID)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	requestLogger(r).Info("Started upload", "upload", u.ID, "name", name, "length", length)
+	w.Header().Set("Location", "/api/v1/uploads/"+u.ID)
+	writeJSON(w, http.StatusCreated, u)
+}
+
+// uploadOffsetHandler tells a client where to carry on from.
+func uploadOffsetHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := loadUpload(r.PathValue("id"), currentUser(r).Name)
+	if !ok {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func getUploadHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := loadUpload(r.PathValue("id"), currentUser(r).Name)
+	if !ok {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, u)
+}
+
+// patchUploadHandler appends to an upload at Upload-Offset. Once all of it
+// has arrived the photo is added, and the finished upload is returned.
+func patchUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Upload-Offset is required", http.StatusBadRequest)
+		return
+	}
+	id := r.PathValue("id")
+	if !startPatching(id) {
+		http.Error(w, errUploadBusy.Error(), http.StatusConflict)
+		return
+	}
+	defer stopPatching(id)
+
+	u, ok := loadUpload(id, currentUser(r).Name)
+	if !ok {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	if offset != u.Offset {
+		http.Error(w, fmt.Sprintf("upload is at offset %d", u.Offset), http.StatusConflict)
+		return
+	}
+
+	if u.Offset < u.Length {
+		f, err := os.OpenFile(uploadFile(id, ".part"), os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Whatever arrives is kept, even if the client goes away part way.
+		n, err := io.Copy(f, io.LimitReader(r.Body, u.Length-u.Offset))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		u.Offset += n
+		if err != nil {
+			requestLogger(r).Warn("Upload interrupted", "upload", id, "offset", u.Offset, "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		if u.Offset < u.Length {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		result, err := addUpload(uploadFile(id, ".part"), u.Name)
+		if err != nil {
+			removeUpload(id)
+			writeUploadError(w, r, u.Name, err)
+			return
+		}
+		requestLogger(r).Info("Uploaded photo", "upload", id, "name", u.Name, "key", result.AssetKey, "duplicate", result.Duplicate)
+		u.AssetKey = result.AssetKey
+		u.Duplicate = result.Duplicate
+		if err := saveUpload(u); err != nil {
+			slog.Warn("Could not save upload", "upload", id, "err", err)
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	writeJSON(w, http.StatusOK, u)
+}
+
+// deleteUploadHandler abandons an upload.
+func deleteUploadHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, ok := loadUpload(id, currentUser(r).Name); !ok {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	if !startPatching(id) {
+		http.Error(w, errUploadBusy.Error(), http.StatusConflict)
+		return
+	}
+	defer stopPatching(id)
+	removeUpload(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// expireUploads removes expired uploads every hour until shutdown.
+func expireUploads() {
+	for {
+		removeExpiredUploads()
+
+		select {
+		case <-time.After(time.Hour):
+		case <-stopping:
+			return
+		}
+	}
+}
+
+// removeExpiredUploads removes uploads that have not been touched for
+// uploadExpiry, finished or not.
+func removeExpiredUploads() {
+	dir := filepath.Join(uploadRoot, uploadsPartialDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Warn("Could not read uploads", "dir", dir, "err", err)
+	}
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		id := strings.TrimSuffix(e.Name(), ext)
+		if ext == ".part" {
+			// Those with state are expired along with it.
+			if _, err := os.Stat(uploadFile(id, ".json")); err == nil {
+				continue
+			}
+		}
+		stale := true
+		for _, name := range []string{e.Name(), id + ".part"} {
+			if info, err := os.Stat(filepath.Join(dir, name)); err == nil && time.Since(info.ModTime()) < uploadExpiry {
+				stale = false
+			}
+		}
+		if stale {
+			slog.Info("Removing expired upload", "file", e.Name())
+			removeUpload(id)
+		}
+	}
+}
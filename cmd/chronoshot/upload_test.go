@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"chronoshot/pkg/db"
+	"chronoshot/pkg/db/dbtest"
+)
+
+// testUploads opens a new database and inbox for the rest of the test.
+func testUploads(t *testing.T) {
+	t.Helper()
+	dbtest.Open(t)
+	saved := uploadRoot
+	setupUploads(t.TempDir())
+	t.Cleanup(func() { uploadRoot = saved })
+}
+
+// testPhoto returns an undated JPEG, which differs for each shade.
+func testPhoto(t *testing.T, shade uint8) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = shade
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// partialUpload writes b where uploads are received, as receiveUpload does.
+func partialUpload(t *testing.T, b []byte) string {
+	t.Helper()
+	tmp, err := receiveUpload(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tmp
+}
+
+func TestUploadName(t *testing.T) {
+	for name, want := range map[string]string{
+		"IMG_1.JPG":                "IMG_1.JPG",
+		"photo.jpeg":               "photo.jpeg",
+		"photo.png":                "photo.png.jpg",
+		"../../etc/passwd":         "passwd.jpg",
+		`C:\Users\me\..\IMG_2.jpg`: "IMG_2.jpg",
+		`..\..\IMG_3.jpg`:          "IMG_3.jpg",
+		".hidden.jpg":              "hidden.jpg",
+		"..":                       "upload.jpg",
+		"/":                        "upload.jpg",
+		"":                         "upload.jpg",
+		"holiday/":                 "holiday.jpg",
+	} {
+		if got := uploadName(name); got != want {
+			t.Errorf("uploadName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestAddUpload(t *testing.T) {
+	testUploads(t)
+	photo := testPhoto(t, 10)
+
+	tmp := partialUpload(t, photo)
+	first, err := addUpload(tmp, "../x.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Duplicate || first.AssetKey == "" {
+		t.Errorf("got %+v for a new photo", first)
+	}
+	// Photos without a date go in their own folder.
+	undated := filepath.Join(uploadRoot, "undated")
+	if !exists(filepath.Join(undated, "x.jpg")) || exists(tmp) {
+		t.Errorf("photo was not moved from %s to %s", tmp, undated)
+	}
+
+	second, err := addUpload(partialUpload(t, photo), "y.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.Duplicate || second.AssetKey != first.AssetKey || exists(filepath.Join(undated, "y.jpg")) {
+		t.Errorf("got %+v for the same photo again", second)
+	}
+
+	// Another photo with the same name is kept beside it.
+	if _, err := addUpload(partialUpload(t, testPhoto(t, 200)), "x.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(filepath.Join(undated, "x-1.jpg")) {
+		t.Error("second x.jpg was not kept as x-1.jpg")
+	}
+
+	if _, err := addUpload(partialUpload(t, []byte("not a photo")), "z.jpg"); err != errNotJPEG {
+		t.Errorf("got %v for a text file, want errNotJPEG", err)
+	}
+}
+
+func TestAddUploadConcurrently(t *testing.T) {
+	testUploads(t)
+	photo := testPhoto(t, 10)
+
+	results := make([]uploadResult, 8)
+	var wg sync.WaitGroup
+	for i := range results {
+		tmp := partialUpload(t, photo)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if results[i], err = addUpload(tmp, "x.jpg"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	added := 0
+	for _, result := range results {
+		if !result.Duplicate {
+			added++
+		}
+		if result.AssetKey != results[0].AssetKey {
+			t.Errorf("keys %s and %s for the same photo", result.AssetKey, results[0].AssetKey)
+		}
+	}
+	if added != 1 {
+		t.Errorf("photo added %d times", added)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(uploadRoot, "undated")); len(entries) != 1 {
+		t.Errorf("%d files in the inbox, want 1", len(entries))
+	}
+}
+
+func TestReserveHash(t *testing.T) {
+	testUploads(t)
+
+	_, release := reserveHash("abc")
+	if release == nil {
+		t.Fatal("new hash was not reserved")
+	}
+	// Other hashes are not held up.
+	if _, other := reserveHash("def"); other == nil {
+		t.Fatal("other hash was not reserved")
+	} else {
+		other()
+	}
+
+	type reservation struct {
+		key     []byte
+		release func()
+	}
+	waiting := make(chan reservation)
+	go func() {
+		key, release := reserveHash("abc")
+		waiting <- reservation{key, release}
+	}()
+	select {
+	case <-waiting:
+		t.Fatal("hash reserved twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	key := dbtest.PutAsset("/photos/a.jpg", time.Now(), db.AssetMeta{ContentHash: "abc"})
+	release()
+	if got := <-waiting; got.release != nil || !bytes.Equal(got.key, key) {
+		t.Errorf("got %s, reserved %t, once the photo was indexed", got.key, got.release != nil)
+	}
+}
+
+func TestReceiveUploadLimit(t *testing.T) {
+	testUploads(t)
+	saved := *uploadMaxSize
+	*uploadMaxSize = 1
+	t.Cleanup(func() { *uploadMaxSize = saved })
+
+	tmp, err := receiveUpload(bytes.NewReader(make([]byte, 1<<20)))
+	if err != nil {
+		t.Fatalf("upload at the limit: %v", err)
+	}
+	os.Remove(tmp)
+	if _, err := receiveUpload(bytes.NewReader(make([]byte, 1<<20+1))); err != errUploadTooLarge {
+		t.Errorf("got %v over the limit, want errUploadTooLarge", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(uploadRoot, uploadsPartialDir)); len(entries) != 0 {
+		t.Errorf("%d files left behind", len(entries))
+	}
+
+	w := tusRequest("alice", createUploadHandler, "POST", "", nil, "Upload-Length", strconv.Itoa(1<<20+1))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("creating an upload over the limit: status %d", w.Code)
+	}
+}
+
+// tusRequest runs h for a request from the named user about the upload
+// with id, with the headers given as pairs.
+func tusRequest(user string, h http.HandlerFunc, method, id string, body []byte, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/api/v1/uploads/"+id, bytes.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), userContextKey, db.User{Name: user}))
+	r.SetPathValue("id", id)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	withTus(h)(w, r)
+	return w
+}
+
+func TestTusUpload(t *testing.T) {
+	testUploads(t)
+	photo := testPhoto(t, 10)
+	half := len(photo) / 2
+
+	w := tusRequest("alice", createUploadHandler, "POST", "", nil,
+		"Upload-Length", strconv.Itoa(len(photo)),
+		"Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(`..\p.jpg`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST: status %d: %s", w.Code, w.Body)
+	}
+	var u upload
+	if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Header().Get("Location"); got != "/api/v1/uploads/"+u.ID {
+		t.Errorf("Location %s", got)
+	}
+
+	patch := func(user string, offset int, body []byte) *httptest.ResponseRecorder {
+		return tusRequest(user, patchUploadHandler, "PATCH", u.ID, body,
+			"Content-Type", "application/offset+octet-stream", "Upload-Offset", strconv.Itoa(offset))
+	}
+	if w := patch("alice", 0, photo[:half]); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Fatalf("first PATCH: status %d, offset %s", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if w := tusRequest("alice", uploadOffsetHandler, "HEAD", u.ID, nil); w.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Errorf("HEAD: offset %s, want %d", w.Header().Get("Upload-Offset"), half)
+	}
+
+	// Sent again from the start, as after a lost response.
+	if w := patch("alice", 0, photo[:half]); w.Code != http.StatusConflict {
+		t.Errorf("PATCH at the wrong offset: status %d", w.Code)
+	}
+	if w := patch("bob", half, photo[half:]); w.Code != http.StatusNotFound {
+		t.Errorf("PATCH by someone else: status %d", w.Code)
+	}
+	startPatching(u.ID)
+	if w := patch("alice", half, photo[half:]); w.Code != http.StatusConflict {
+		t.Errorf("PATCH while another is running: status %d", w.Code)
+	}
+	stopPatching(u.ID)
+	w = tusRequest("alice", patchUploadHandler, "PATCH", u.ID, photo[half:], "Upload-Offset", strconv.Itoa(half))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("PATCH without Content-Type: status %d", w.Code)
+	}
+
+	w = patch("alice", half, photo[half:])
+	if w.Code != http.StatusOK {
+		t.Fatalf("last PATCH: status %d: %s", w.Code, w.Body)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.AssetKey == "" || u.Duplicate || u.Offset != int64(len(photo)) {
+		t.Errorf("finished upload %+v", u)
+	}
+	if !exists(filepath.Join(uploadRoot, "undated", "p.jpg")) {
+		t.Error("photo is not in the inbox as p.jpg")
+	}
+
+	if w := tusRequest("alice", createUploadHandler, "POST", "", nil, "Upload-Length", "0"); w.Code != http.StatusBadRequest {
+		t.Errorf("POST of an empty upload: status %d", w.Code)
+	}
+	if w := tusRequest("alice", createUploadHandler, "POST", "", nil, "Tus-Resumable", "0.2.2", "Upload-Length", "1"); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("POST in another tus version: status %d", w.Code)
+	}
+}
+
+func TestRemoveExpiredUploads(t *testing.T) {
+	testUploads(t)
+	dir := filepath.Join(uploadRoot, uploadsPartialDir)
+	old := time.Now().Add(-uploadExpiry - time.Hour)
+	touch := func(name string, modTime time.Time) {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	touch("old.json", old)
+	touch("old.part", old)
+	touch("new.json", time.Now())
+	touch("new.part", time.Now())
+	// Still being written to, though created long ago.
+	touch("resumed.json", old)
+	touch("resumed.part", time.Now())
+	// Left by a multipart upload that never finished.
+	touch("multipart-1.part", old)
+
+	removeExpiredUploads()
+	for name, want := range map[string]bool{
+		"old.json": false, "old.part": false,
+		"new.json": true, "new.part": true,
+		"resumed.json": true, "resumed.part": true,
+		"multipart-1.part": false,
+	} {
+		if got := exists(filepath.Join(dir, name)); got != want {
+			t.Errorf("%s kept %t, want %t", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"chronoshot/pkg/db"
+)
+
+// apiUser is a user as admins see them, without their password hash.
+type apiUser struct {
+	Name    string
+	IsAdmin bool
+	Created time.Time
+}
+
+// getUsersHandler lists every user.
+func getUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users := []apiUser{}
+	for _, u := range db.GetUsers() {
+		users = append(users, apiUser{Name: u.Name, IsAdmin: u.IsAdmin, Created: u.Created})
+	}
+	writeJSON(w, http.StatusOK, users)
+}
+
+// createUserHandler adds a user, as "chronoshot adduser" does while the
+// server is stopped.
+func createUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name     string
+		Password string
+		IsAdmin  bool
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u := db.User{Name: req.Name, PasswordHash: hash, IsAdmin: req.IsAdmin, Created: time.Now()}
+	if err := db.CreateUser(u); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, db.ErrUserExists) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSON(w, http.StatusCreated, apiUser{Name: u.Name, IsAdmin: u.IsAdmin, Created: u.Created})
+}
+
+// setPasswordHandler changes a user's password, as "chronoshot passwd" does
+// while the server is stopped.
+func setPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Password string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := db.SetPassword(r.PathValue("name"), hash); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, db.ErrUserNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
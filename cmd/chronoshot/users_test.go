@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"chronoshot/pkg/db"
+	"chronoshot/pkg/db/dbtest"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestUserHandlers(t *testing.T) {
+	dbtest.Open(t)
+
+	for body, want := range map[string]int{
+		`{"Name":"bob","Password":"correct horse","IsAdmin":true}`: http.StatusCreated,
+		`{"Name":"bob","Password":"battery staple"}`:               http.StatusConflict,
+		`{"Name":"carol","Password":"short"}`:                      http.StatusBadRequest,
+		`{"Password":"correct horse"}`:                             http.StatusBadRequest,
+		`not json`:                                                 http.StatusBadRequest,
+	} {
+		if w := serveAs("admin", createUserHandler, "POST", "/api/v1/users", body); w.Code != want {
+			t.Errorf("POST %s: status %d, want %d: %s", body, w.Code, want, w.Body)
+		}
+	}
+
+	w := serveAs("admin", getUsersHandler, "GET", "/api/v1/users", "")
+	var users []apiUser
+	if err := json.Unmarshal(w.Body.Bytes(), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Name != "bob" || !users[0].IsAdmin {
+		t.Errorf("users %+v", users)
+	}
+
+	put := func(name, body string) int {
+		r := serveAs("admin", func(w http.ResponseWriter, r *http.Request) {
+			r.SetPathValue("name", name)
+			setPasswordHandler(w, r)
+		}, "PUT", "/api/v1/users/"+name+"/password", body)
+		return r.Code
+	}
+	if got := put("bob", `{"Password":"battery staple"}`); got != http.StatusNoContent {
+		t.Fatalf("PUT: status %d", got)
+	}
+	u, _ := db.GetUser("bob")
+	if bcrypt.CompareHashAndPassword(u.PasswordHash, []byte("battery staple")) != nil {
+		t.Error("password not changed")
+	}
+	if got := put("carol", `{"Password":"battery staple"}`); got != http.StatusNotFound {
+		t.Errorf("PUT for a missing user: status %d", got)
+	}
+	if got := put("bob", `{"Password":"short"}`); got != http.StatusBadRequest {
+		t.Errorf("PUT of a short password: status %d", got)
+	}
+}
+
+func TestUsersAreAdminOnly(t *testing.T) {
+	for _, path := range []string{"/api/v1/users", "/api/v1/users/bob/password"} {
+		if !isAdminPath(path) {
+			t.Errorf("%s is not an admin path", path)
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Namespaces of the XMP properties chronoshot reads and writes.
+const (
+	nsRDF        = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	nsDC         = "http://purl.org/dc/elements/1.1/"
+	nsXMP        = "http://ns.adobe.com/xap/1.0/"
+	nsEXIF       = "http://ns.adobe.com/exif/1.0/"
+	nsPhotoshop  = "http://ns.adobe.com/photoshop/1.0/"
+	nsIPTCCore   = "http://iptc.org/std/Iptc4xmpCore/1.0/xmlns/"
+	nsChronoshot = "https://github.com/vjdw/chronoshot/ns/1.0/"
+)
+
+// Prefixes used when a namespace has to be declared.
+var xmpPrefixes = map[string]string{
+	nsRDF:        "rdf",
+	nsDC:         "dc",
+	nsXMP:        "xmp",
+	nsEXIF:       "exif",
+	nsChronoshot: "chronoshot",
+}
+
+// xmpMeta is what chronoshot reads from an XMP packet.
+type xmpMeta struct {
+	Caption     string // dc:description
+	Description string // exif:UserComment
+	Keywords    []string
+	Rating      int // -1 for rejected
+	Label       string
+	Favourite   bool
+	City        string // photoshop:City
+	State       string // photoshop:State
+	Country     string // photoshop:Country
+	Location    string // Iptc4xmpCore:Location, within the city
+}
+
+// xmpProps are the properties to replace in an XMP packet. Nil fields are
+// left as they are.
+type xmpProps struct {
+	Caption     *string
+	Description *string
+	Keywords    *[]string
+	Rating      *int
+	Favourite   *bool
+}
+
+// xmpNode is an element of an XMP packet. Names keep their original prefix
+// in Space, and everything chronoshot does not understand is kept as it is,
+// so that sidecars written by other tools can be updated without loss.
+type xmpNode struct {
+	Name     xml.Name
+	Attr     []xml.Attr
+	Children []any // *xmpNode, xml.CharData, xml.Comment, xml.ProcInst or xml.Directive
+}
+
+// xmpScope maps namespace prefixes to URLs within an element.
+type xmpScope map[string]string
+
+func (s xmpScope) with(attrs []xml.Attr) xmpScope {
+	inner := s
+	copied := false
+	for _, a := range attrs {
+		if a.Name.Space != "xmlns" {
+			continue
+		}
+		if !copied {
+			inner = make(xmpScope, len(s)+1)
+			for k, v := range s {
+				inner[k] = v
+			}
+			copied = true
+		}
+		inner[a.Name.Local] = a.Value
+	}
+	return inner
+}
+
+func (s xmpScope) is(name xml.Name, ns string, local string) bool {
+	return name.Local == local && s[name.Space] == ns
+}
+
+// prefix returns a prefix bound to ns, and whether it needs declaring.
+func (s xmpScope) prefix(ns string) (string, bool) {
+	for p, u := range s {
+		if u == ns {
+			return p, false
+		}
+	}
+	p := xmpPrefixes[ns]
+	for i := 1; s[p] != ""; i++ {
+		p = xmpPrefixes[ns] + strconv.Itoa(i)
+	}
+	return p, true
+}
+
+// emptyXMP is the packet that new sidecars start from.
+const emptyXMP = `<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""/>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>
+`
+
+// findXMP returns the XMP packet embedded in a file, or nil.
+func findXMP(b []byte) []byte {
+	start := bytes.Index(b, []byte("<x:xmpmeta"))
+	if start < 0 {
+		return nil
+	}
+	end := bytes.Index(b[start:], []byte("</x:xmpmeta>"))
+	if end < 0 {
+		return nil
+	}
+	return b[start : start+end+len("</x:xmpmeta>")]
+}
+
+// parseXMPDoc reads an XMP packet into a node holding its top level.
+func parseXMPDoc(b []byte) (*xmpNode, error) {
+	doc := &xmpNode{}
+	stack := []*xmpNode{doc}
+	d := xml.NewDecoder(bytes.NewReader(b))
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		parent := stack[len(stack)-1]
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &xmpNode{Name: t.Name, Attr: t.Copy().Attr}
+			parent.Children = append(parent.Children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) == 1 {
+				return nil, errors.New("unbalanced XMP")
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			parent.Children = append(parent.Children, xml.CopyToken(tok))
+		}
+	}
+	if len(stack) != 1 {
+		return nil, errors.New("unbalanced XMP")
+	}
+	return doc, nil
+}
+
+// descriptions calls f for every rdf:Description in the packet.
+func (n *xmpNode) descriptions(scope xmpScope, f func(d *xmpNode, scope xmpScope)) {
+	for _, c := range n.Children {
+		if child, ok := c.(*xmpNode); ok {
+			inner := scope.with(child.Attr)
+			if inner.is(child.Name, nsRDF, "Description") {
+				f(child, inner)
+			} else {
+				child.descriptions(inner, f)
+			}
+		}
+	}
+}
+
+// text returns the character data directly inside n.
+func (n *xmpNode) text() string {
+	var s strings.Builder
+	for _, c := range n.Children {
+		if t, ok := c.(xml.CharData); ok {
+			s.Write(t)
+		}
+	}
+	return strings.TrimSpace(s.String())
+}
+
+// items returns the text of the rdf:li elements of an rdf:Alt, rdf:Bag or
+// rdf:Seq in n, putting any x-default language first.
+func (n *xmpNode) items(scope xmpScope) []string {
+	var items []string
+	for _, c := range n.Children {
+		container, ok := c.(*xmpNode)
+		if !ok {
+			continue
+		}
+		inner := scope.with(container.Attr)
+		for _, c := range container.Children {
+			li, ok := c.(*xmpNode)
+			if !ok || !inner.is(li.Name, nsRDF, "li") {
+				continue
+			}
+			if isDefaultLang(li.Attr) {
+				items = append([]string{li.text()}, items...)
+			} else {
+				items = append(items, li.text())
+			}
+		}
+	}
+	return items
+}
+
+func isDefaultLang(attrs []xml.Attr) bool {
+	for _, a := range attrs {
+		if a.Name.Space == "xml" && a.Name.Local == "lang" {
+			return a.Value == "x-default"
+		}
+	}
+	return false
+}
+
+// readXMP returns the properties chronoshot understands from an XMP packet.
+func readXMP(b []byte) (xmpMeta, error) {
+	var meta xmpMeta
+	doc, err := parseXMPDoc(b)
+	if err != nil {
+		return meta, err
+	}
+	doc.descriptions(xmpScope{}, func(d *xmpNode, scope xmpScope) {
+		property := func(ns, local string, value string) {
+			switch {
+			case ns == nsXMP && local == "Rating":
+				if r, err := strconv.ParseFloat(value, 64); err == nil {
+					meta.Rating = max(-1, min(5, int(r)))
+				}
+			case ns == nsXMP && local == "Label":
+				meta.Label = value
+			case ns == nsChronoshot && local == "Favourite":
+				meta.Favourite = strings.EqualFold(value, "true")
+			case ns == nsPhotoshop && local == "City":
+				meta.City = value
+			case ns == nsPhotoshop && local == "State":
+				meta.State = value
+			case ns == nsPhotoshop && local == "Country":
+				meta.Country = value
+			case ns == nsIPTCCore && local == "Location":
+				meta.Location = value
+			}
+		}
+		for _, a := range d.Attr {
+			property(scope[a.Name.Space], a.Name.Local, a.Value)
+		}
+		for _, c := range d.Children {
+			child, ok := c.(*xmpNode)
+			if !ok {
+				continue
+			}
+			inner := scope.with(child.Attr)
+			ns := inner[child.Name.Space]
+			switch {
+			case ns == nsDC && child.Name.Local == "description":
+				if items := child.items(inner); len(items) > 0 {
+					meta.Caption = items[0]
+				}
+			case ns == nsEXIF && child.Name.Local == "UserComment":
+				if items := child.items(inner); len(items) > 0 {
+					meta.Description = items[0]
+				}
+			case ns == nsDC && child.Name.Local == "subject":
+				meta.Keywords = append(meta.Keywords, child.items(inner)...)
+			default:
+				property(ns, child.Name.Local, child.text())
+			}
+		}
+	})
+	return meta, nil
+}
+
+// updateXMP replaces the properties set in p, keeping everything else in the
+// packet b. An empty b starts a new packet.
+func updateXMP(b []byte, p xmpProps) ([]byte, error) {
+	if len(bytes.TrimSpace(b)) == 0 {
+		b = []byte(emptyXMP)
+	}
+	doc, err := parseXMPDoc(b)
+	if err != nil {
+		return nil, err
+	}
+
+	replaced := func(ns, local string) bool {
+		switch {
+		case ns == nsDC && local == "description":
+			return p.Caption != nil
+		case ns == nsEXIF && local == "UserComment":
+			return p.Description != nil
+		case ns == nsDC && local == "subject":
+			return p.Keywords != nil
+		case ns == nsXMP && local == "Rating":
+			return p.Rating != nil
+		case ns == nsChronoshot && local == "Favourite":
+			return p.Favourite != nil
+		}
+		return false
+	}
+
+	// Remove the old values wherever they are, then write the new ones to
+	// the first description.
+	var first *xmpNode
+	var firstScope xmpScope
+	doc.descriptions(xmpScope{}, func(d *xmpNode, scope xmpScope) {
+		if first == nil {
+			first, firstScope = d, scope
+		}
+		attrs := d.Attr[:0]
+		for _, a := range d.Attr {
+			if a.Name.Space == "xmlns" || !replaced(scope[a.Name.Space], a.Name.Local) {
+				attrs = append(attrs, a)
+			}
+		}
+		d.Attr = attrs
+		var children []any
+		for _, c := range d.Children {
+			if child, ok := c.(*xmpNode); ok {
+				inner := scope.with(child.Attr)
+				if replaced(inner[child.Name.Space], child.Name.Local) {
+					// Drop the indentation before it too.
+					if len(children) > 0 {
+						if _, ok := children[len(children)-1].(xml.CharData); ok {
+							children = children[:len(children)-1]
+						}
+					}
+					continue
+				}
+			}
+			children = append(children, c)
+		}
+		d.Children = children
+	})
+	if first == nil {
+		return nil, errors.New("XMP has no rdf:Description")
+	}
+
+	name := func(ns, local string) xml.Name {
+		prefix, declare := firstScope.prefix(ns)
+		if declare {
+			first.Attr = append(first.Attr, xml.Attr{Name: xml.Name{Space: "xmlns", Local: prefix}, Value: ns})
+			firstScope = firstScope.with(first.Attr[len(first.Attr)-1:])
+		}
+		return xml.Name{Space: prefix, Local: local}
+	}
+	// Trailing white space goes back after the new properties.
+	var tail []any
+	if n := len(first.Children); n > 0 {
+		if t, ok := first.Children[n-1].(xml.CharData); ok && len(bytes.TrimSpace(t)) == 0 {
+			tail = []any{t}
+			first.Children = first.Children[:n-1]
+		}
+	}
+	indent := xml.CharData("\n   ")
+	list := func(ns, local, container string, items []string, lang bool) {
+		li := name(nsRDF, "li")
+		c := &xmpNode{Name: name(nsRDF, container)}
+		for _, item := range items {
+			n := &xmpNode{Name: li, Children: []any{xml.CharData(item)}}
+			if lang {
+				n.Attr = []xml.Attr{{Name: xml.Name{Space: "xml", Local: "lang"}, Value: "x-default"}}
+			}
+			c.Children = append(c.Children, xml.CharData("\n     "), n)
+		}
+		c.Children = append(c.Children, xml.CharData("\n    "))
+		first.Children = append(first.Children, indent, &xmpNode{
+			Name:     name(ns, local),
+			Children: []any{xml.CharData("\n    "), c, indent},
+		})
+	}
+
+	if p.Rating != nil {
+		rating := name(nsXMP, "Rating")
+		first.Attr = append(first.Attr, xml.Attr{Name: rating, Value: strconv.Itoa(*p.Rating)})
+	}
+	if p.Favourite != nil && *p.Favourite {
+		favourite := name(nsChronoshot, "Favourite")
+		first.Attr = append(first.Attr, xml.Attr{Name: favourite, Value: "True"})
+	}
+	if p.Caption != nil && *p.Caption != "" {
+		list(nsDC, "description", "Alt", []string{*p.Caption}, true)
+	}
+	if p.Description != nil && *p.Description != "" {
+		list(nsEXIF, "UserComment", "Alt", []string{*p.Description}, true)
+	}
+	if p.Keywords != nil && len(*p.Keywords) > 0 {
+		list(nsDC, "subject", "Bag", *p.Keywords, false)
+	}
+	if len(tail) == 0 && len(first.Children) > 0 {
+		tail = []any{xml.CharData("\n  ")}
+	}
+	first.Children = append(first.Children, tail...)
+
+	var out bytes.Buffer
+	for _, c := range doc.Children {
+		writeXMPNode(&out, c)
+	}
+	return out.Bytes(), nil
+}
+
+var (
+	xmlTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	xmlAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "\n", "&#xA;", "\t", "&#x9;")
+)
+
+func xmlQName(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
+
+func writeXMPNode(w *bytes.Buffer, c any) {
+	switch t := c.(type) {
+	case *xmpNode:
+		w.WriteString("<" + xmlQName(t.Name))
+		for _, a := range t.Attr {
+			w.WriteString(" " + xmlQName(a.Name) + `="` + xmlAttrEscaper.Replace(a.Value) + `"`)
+		}
+		if len(t.Children) == 0 {
+			w.WriteString("/>")
+			return
+		}
+		w.WriteString(">")
+		for _, child := range t.Children {
+			writeXMPNode(w, child)
+		}
+		w.WriteString("</" + xmlQName(t.Name) + ">")
+	case xml.CharData:
+		w.WriteString(xmlTextEscaper.Replace(string(t)))
+	case xml.Comment:
+		w.WriteString("<!--" + string(t) + "-->")
+	case xml.ProcInst:
+		w.WriteString("<?" + t.Target)
+		if len(t.Inst) > 0 {
+			w.WriteString(" " + string(t.Inst))
+		}
+		w.WriteString("?>")
+	case xml.Directive:
+		w.WriteString("<!" + string(t) + ">")
+	}
+}
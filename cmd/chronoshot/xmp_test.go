@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// A sidecar as darktable writes it, with a place added by another tool under
+// its own prefix.
+const testSidecar = `<?xml version="1.0" encoding="UTF-8"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/" x:xmptk="XMP Core 4.4.0-Exiv2">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    xmlns:ps="http://ns.adobe.com/photoshop/1.0/"
+    xmlns:darktable="http://darktable.sf.net/"
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+   xmp:Rating="3"
+   xmp:Label="Red"
+   ps:City="Lisbon"
+   ps:Country="Portugal"
+   darktable:history_end="4">
+   <dc:subject>
+    <rdf:Bag>
+     <rdf:li>beach</rdf:li>
+     <rdf:li>family</rdf:li>
+    </rdf:Bag>
+   </dc:subject>
+   <dc:description>
+    <rdf:Alt>
+     <rdf:li xml:lang="pt-PT">Na praia</rdf:li>
+     <rdf:li xml:lang="x-default">On the beach &amp; pier</rdf:li>
+    </rdf:Alt>
+   </dc:description>
+  </rdf:Description>
+  <rdf:Description rdf:about=""
+    xmlns:Iptc4xmpCore="http://iptc.org/std/Iptc4xmpCore/1.0/xmlns/"
+    xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/">
+   <Iptc4xmpCore:Location>Belém</Iptc4xmpCore:Location>
+   <photoshop:State>Lisboa</photoshop:State>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+`
+
+func TestReadXMP(t *testing.T) {
+	got, err := readXMP([]byte(testSidecar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := xmpMeta{
+		Caption:  "On the beach & pier",
+		Keywords: []string{"beach", "family"},
+		Rating:   3,
+		Label:    "Red",
+		City:     "Lisbon",
+		State:    "Lisboa",
+		Country:  "Portugal",
+		Location: "Belém",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestReadXMPRatings(t *testing.T) {
+	for rating, want := range map[string]int{"-1": -1, "4.0": 4, "9": 5, "-5": -1, "none": 0} {
+		b := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+			`<rdf:Description xmlns:xmp="http://ns.adobe.com/xap/1.0/"><xmp:Rating>` + rating + `</xmp:Rating></rdf:Description>` +
+			`</rdf:RDF></x:xmpmeta>`
+		got, err := readXMP([]byte(b))
+		if err != nil {
+			t.Fatalf("%s: %v", rating, err)
+		}
+		if got.Rating != want {
+			t.Errorf("%s: rating %d, want %d", rating, got.Rating, want)
+		}
+	}
+}
+
+func TestUpdateXMP(t *testing.T) {
+	caption := "Sunset <3"
+	keywords := []string{"beach", "sunset"}
+	rating := 5
+	favourite := true
+	b, err := updateXMP([]byte(testSidecar), xmpProps{
+		Caption:   &caption,
+		Keywords:  &keywords,
+		Rating:    &rating,
+		Favourite: &favourite,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readXMP(b)
+	if err != nil {
+		t.Fatalf("%v in\n%s", err, b)
+	}
+	want := xmpMeta{
+		Caption:   caption,
+		Keywords:  keywords,
+		Rating:    5,
+		Label:     "Red",
+		Favourite: true,
+		City:      "Lisbon",
+		State:     "Lisboa",
+		Country:   "Portugal",
+		Location:  "Belém",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v in\n%s", got, want, b)
+	}
+	// Everything else is kept.
+	for _, s := range []string{`darktable:history_end="4"`, `xmp:Label="Red"`, `<Iptc4xmpCore:Location>Belém`} {
+		if !bytes.Contains(b, []byte(s)) {
+			t.Errorf("%s was lost from\n%s", s, b)
+		}
+	}
+
+	// Clearing a property removes it.
+	var none []string
+	favourite = false
+	b, err = updateXMP(b, xmpProps{Keywords: &none, Favourite: &favourite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := readXMP(b); got.Keywords != nil || got.Favourite || got.Caption != caption {
+		t.Errorf("got %+v after clearing keywords and favourite in\n%s", got, b)
+	}
+}
+
+func TestUpdateXMPNewPacket(t *testing.T) {
+	caption, description := "Caption", "Description"
+	keywords := []string{"a", "b"}
+	b, err := updateXMP(nil, xmpProps{Caption: &caption, Description: &description, Keywords: &keywords})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if findXMP(b) == nil {
+		t.Errorf("no packet in\n%s", b)
+	}
+	got, err := readXMP(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := xmpMeta{Caption: caption, Description: description, Keywords: keywords}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v in\n%s", got, want, b)
+	}
+}
+
+func TestUpdateXMPWithoutDescription(t *testing.T) {
+	b := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"></rdf:RDF></x:xmpmeta>`
+	rating := 1
+	if _, err := updateXMP([]byte(b), xmpProps{Rating: &rating}); err == nil {
+		t.Error("no error")
+	}
+}
+
+func TestFindXMP(t *testing.T) {
+	packet := `<x:xmpmeta xmlns:x="adobe:ns:meta/"></x:xmpmeta>`
+	if got := findXMP([]byte("\xff\xd8\xff\xe1..http://ns.adobe.com/xap/1.0/\x00" + packet + "\xff\xd9")); string(got) != packet {
+		t.Errorf("got %q", got)
+	}
+	if got := findXMP([]byte("<x:xmpmeta xmlns:x=")); got != nil {
+		t.Errorf("got %q from a truncated packet", got)
+	}
+}
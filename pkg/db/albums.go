@@ -0,0 +1,282 @@
+package db
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var ErrAlbumNotFound = errors.New("album not found")
+var ErrForbidden = errors.New("not permitted")
+
+// Access levels an album can be shared with.
+const (
+	AccessRead = "read"
+	AccessEdit = "edit"
+)
+
+type Album struct {
+	ID      string
+	Name    string
+	Owner   string
+	Shares  map[string]string // user name to AccessRead or AccessEdit
+	Created time.Time
+}
+
+// CanView reports whether userName may see the album's contents.
+func (a Album) CanView(userName string) bool {
+	return a.Owner == userName || a.Shares[userName] != ""
+}
+
+// CanEdit reports whether userName may add and remove assets.
+func (a Album) CanEdit(userName string) bool {
+	return a.Owner == userName || a.Shares[userName] == AccessEdit
+}
+
+// Assets in an album are kept in their own bucket, keyed like "all".
+func albumBucket(id string) []byte {
+	return []byte("album:" + id)
+}
+
+func deserialiseAlbum(buf []byte) (Album, error) {
+	var a Album
+	err := gob.NewDecoder(bytes.NewBuffer(buf)).Decode(&a)
+	if a.Shares == nil {
+		// gob drops empty maps.
+		a.Shares = make(map[string]string)
+	}
+	return a, err
+}
+
+// ResolveSet maps a set name as used by clients to the bucket holding it, as
+// seen by userName. Sets are "all", "selections" for the user's favourites,
+// "album:<id>" for albums the user owns or has been shared, "tag:<name>"
+// for assets with a tag and "trash", which holds the assets left out of all
+// the others. Smart albums, "smart:<id>", have no bucket and are
+// searched for instead.
+func ResolveSet(userName string, setName string) ([]byte, error) {
+	switch {
+	case setName == "all":
+		return []byte("all"), nil
+	case setName == "selections":
+		return selectionsBucket(userName), nil
+	case setName == trashBucket:
+		return []byte(trashBucket), nil
+	case strings.HasPrefix(setName, "album:"):
+		album, err := GetAlbum(strings.TrimPrefix(setName, "album:"))
+		if err != nil {
+			return nil, err
+		}
+		if !album.CanView(userName) {
+			return nil, ErrAlbumNotFound
+		}
+		return albumBucket(album.ID), nil
+	case strings.HasPrefix(setName, "tag:"):
+		return tagBucket(strings.TrimPrefix(setName, "tag:")), nil
+	}
+	return nil, fmt.Errorf("unknown set %q", setName)
+}
+
+func CreateAlbum(owner string, name string) (Album, error) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Album{}, err
+	}
+	album := Album{
+		ID:      hex.EncodeToString(id),
+		Name:    name,
+		Owner:   owner,
+		Shares:  make(map[string]string),
+		Created: time.Now(),
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucket(albumBucket(album.ID)); err != nil {
+			return err
+		}
+		return putAlbumTx(tx, album)
+	})
+	return album, err
+}
+
+func putAlbumTx(tx *bolt.Tx, album Album) error {
+	serialisedAlbum, err := serialise(album)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("albums")).Put([]byte(album.ID), serialisedAlbum)
+}
+
+func GetAlbum(id string) (Album, error) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var album Album
+	err = db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket([]byte("albums")).Get([]byte(id))
+		if buf == nil {
+			return ErrAlbumNotFound
+		}
+		album, err = deserialiseAlbum(buf)
+		return err
+	})
+	return album, err
+}
+
+// GetAlbums returns the albums userName owns or has been shared.
+func GetAlbums(userName string) []Album {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var albums []Album
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("albums")).ForEach(func(k, v []byte) error {
+			album, err := deserialiseAlbum(v)
+			if err != nil {
+				return err
+			}
+			if album.CanView(userName) {
+				albums = append(albums, album)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return albums
+}
+
+// UpdateAlbum applies change to an album, provided userName owns it.
+func UpdateAlbum(userName string, id string, change func(*Album) error) (Album, error) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var album Album
+	err = db.Update(func(tx *bolt.Tx) error {
+		buf := tx.Bucket([]byte("albums")).Get([]byte(id))
+		if buf == nil {
+			return ErrAlbumNotFound
+		}
+		album, err = deserialiseAlbum(buf)
+		if err != nil {
+			return err
+		}
+		if !album.CanView(userName) {
+			return ErrAlbumNotFound
+		}
+		if album.Owner != userName {
+			return ErrForbidden
+		}
+		if err := change(&album); err != nil {
+			return err
+		}
+		return putAlbumTx(tx, album)
+	})
+	return album, err
+}
+
+// DeleteAlbum removes an album owned by userName. The assets in it are not
+// affected.
+func DeleteAlbum(userName string, id string) error {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		buf := tx.Bucket([]byte("albums")).Get([]byte(id))
+		if buf == nil {
+			return ErrAlbumNotFound
+		}
+		album, err := deserialiseAlbum(buf)
+		if err != nil {
+			return err
+		}
+		if !album.CanView(userName) {
+			return ErrAlbumNotFound
+		}
+		if album.Owner != userName {
+			return ErrForbidden
+		}
+		if err := tx.DeleteBucket(albumBucket(id)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return tx.Bucket([]byte("albums")).Delete([]byte(id))
+	})
+	clearAssetKeysCache()
+	return err
+}
+
+// PutAlbumAssets adds assets to, or removes them from, an album that userName
+// owns or can edit. Unknown asset keys are ignored.
+func PutAlbumAssets(userName string, id string, keyHashes [][]byte, add bool) error {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := editableAlbumBucketTx(tx, userName, id)
+		if err != nil {
+			return err
+		}
+
+		assetsLookup := tx.Bucket([]byte("assetsLookup"))
+		for _, keyHash := range keyHashes {
+			if !add {
+				if err := b.Delete(keyHash); err != nil {
+					return err
+				}
+				continue
+			}
+			if assetKey := assetsLookup.Get(keyHash); assetKey != nil {
+				if err := b.Put(keyHash, assetKey); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	clearAssetKeysCache()
+	return err
+}
+
+// editableAlbumBucketTx returns the bucket of an album userName can edit.
+func editableAlbumBucketTx(tx *bolt.Tx, userName string, id string) (*bolt.Bucket, error) {
+	buf := tx.Bucket([]byte("albums")).Get([]byte(id))
+	if buf == nil {
+		return nil, ErrAlbumNotFound
+	}
+	album, err := deserialiseAlbum(buf)
+	if err != nil {
+		return nil, err
+	}
+	if !album.CanView(userName) {
+		return nil, ErrAlbumNotFound
+	}
+	if !album.CanEdit(userName) {
+		return nil, ErrForbidden
+	}
+	return tx.Bucket(albumBucket(id)), nil
+}
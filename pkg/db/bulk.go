@@ -0,0 +1,117 @@
+package db
+
+import (
+	"log"
+
+	"github.com/boltdb/bolt"
+)
+
+// BulkChange describes changes made to many assets at once. Nil and empty
+// fields leave that aspect of the assets alone.
+type BulkChange struct {
+	Favourite        *bool
+	Rating           *int // 0 clears the rating
+	AddTags          []string
+	RemoveTags       []string
+	AddToAlbums      []string
+	RemoveFromAlbums []string
+	ShiftDate        *DateShift `json:"-"`
+}
+
+// ApplyBulkChange makes c to every asset in keyHashes, as userName, in a
+// single transaction: if any asset is unknown or any album cannot be edited,
+// nothing is changed. Assets listed twice are changed once, so that a date
+// shift is not applied twice.
+func ApplyBulkChange(userName string, keyHashes [][]byte, c BulkChange) error {
+	// Favourites and ratings set one at a time are stored in the background,
+	// and must not land on top of this change.
+	Sync()
+
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	seen := make(map[string]bool, len(keyHashes))
+	unique := keyHashes[:0:0]
+	for _, keyHash := range keyHashes {
+		if !seen[string(keyHash)] {
+			seen[string(keyHash)] = true
+			unique = append(unique, keyHash)
+		}
+	}
+	keyHashes = unique
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		type albumChange struct {
+			b   *bolt.Bucket
+			add bool
+		}
+		var albums []albumChange
+		for _, id := range c.AddToAlbums {
+			b, err := editableAlbumBucketTx(tx, userName, id)
+			if err != nil {
+				return err
+			}
+			albums = append(albums, albumChange{b, true})
+		}
+		for _, id := range c.RemoveFromAlbums {
+			b, err := editableAlbumBucketTx(tx, userName, id)
+			if err != nil {
+				return err
+			}
+			albums = append(albums, albumChange{b, false})
+		}
+
+		assetsLookup := tx.Bucket([]byte("assetsLookup"))
+		for _, keyHash := range keyHashes {
+			assetKey := assetsLookup.Get(keyHash)
+			if assetKey == nil {
+				return ErrAssetNotFound
+			}
+			if c.Favourite != nil {
+				if err := putSelectionTx(tx, selection{userName, keyHash, *c.Favourite}); err != nil {
+					return err
+				}
+			}
+			if c.Rating != nil {
+				if err := putRatingTx(tx, assetRating{userName, keyHash, *c.Rating}); err != nil {
+					return err
+				}
+			}
+			for _, tag := range c.AddTags {
+				if err := putAssetTagTx(tx, keyHash, tag, true); err != nil {
+					return err
+				}
+			}
+			for _, tag := range c.RemoveTags {
+				if err := putAssetTagTx(tx, keyHash, tag, false); err != nil {
+					return err
+				}
+			}
+			if c.ShiftDate != nil {
+				info, err := assetInfoTx(tx, keyHash)
+				if err != nil {
+					return err
+				}
+				if err := putDateTimeTx(tx, info, c.ShiftDate.Apply(dateTimeTx(tx, info))); err != nil {
+					return err
+				}
+			}
+			for _, album := range albums {
+				var err error
+				if album.add {
+					err = album.b.Put(keyHash, assetKey)
+				} else {
+					err = album.b.Delete(keyHash)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	clearAssetKeysCache()
+	return err
+}
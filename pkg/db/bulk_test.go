@@ -0,0 +1,58 @@
+package db_test
+
+import (
+	"testing"
+	"time"
+
+	"chronoshot/pkg/db"
+	"chronoshot/pkg/db/dbtest"
+)
+
+func TestApplyBulkChangeShiftsDuplicatesOnce(t *testing.T) {
+	dbtest.Open(t)
+	taken := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	key := dbtest.PutAsset("/photos/a.jpg", taken, db.AssetMeta{})
+	other := dbtest.PutAsset("/photos/b.jpg", taken, db.AssetMeta{})
+
+	shift := db.BulkChange{ShiftDate: &db.DateShift{Duration: time.Hour}}
+	if err := db.ApplyBulkChange("alice", [][]byte{key, other, key}, shift); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range [][]byte{key, other} {
+		if got, want := db.GetDateTime(k), taken.Add(time.Hour); !got.Equal(want) {
+			t.Errorf("%s: date %v, want %v", k, got, want)
+		}
+	}
+}
+
+func TestApplyBulkChangeUnknownAsset(t *testing.T) {
+	dbtest.Open(t)
+	taken := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	key := dbtest.PutAsset("/photos/a.jpg", taken, db.AssetMeta{})
+
+	shift := db.BulkChange{ShiftDate: &db.DateShift{Days: 1}}
+	if err := db.ApplyBulkChange("alice", [][]byte{key, []byte("missing")}, shift); err != db.ErrAssetNotFound {
+		t.Fatalf("got %v, want ErrAssetNotFound", err)
+	}
+	if got := db.GetDateTime(key); !got.Equal(taken) {
+		t.Errorf("date changed to %v although the change failed", got)
+	}
+}
+
+func TestApplyBulkChangeAfterSingleChanges(t *testing.T) {
+	dbtest.Open(t)
+	key := dbtest.PutAsset("/photos/a.jpg", time.Now(), db.AssetMeta{})
+
+	for range 20 {
+		db.PutSelection("alice", key, true)
+		db.PutRating("alice", key, 5)
+		favourite, rating := false, 2
+		if err := db.ApplyBulkChange("alice", [][]byte{key}, db.BulkChange{Favourite: &favourite, Rating: &rating}); err != nil {
+			t.Fatal(err)
+		}
+		db.Sync()
+		if db.GetIsSelected("alice", key) || db.GetRating("alice", key) != 2 {
+			t.Fatal("an earlier single change overwrote the bulk change")
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// Longest caption and description accepted, in bytes.
+const (
+	maxCaptionLength     = 2000
+	maxDescriptionLength = 20000
+)
+
+// AssetCaption is the text written about an asset. Until someone edits it,
+// an asset's caption is the one read from the file when it was indexed.
+type AssetCaption struct {
+	Caption     string
+	Description string
+}
+
+// NormaliseCaption trims c and checks it is not too long.
+func NormaliseCaption(c AssetCaption) (AssetCaption, error) {
+	c.Caption = strings.TrimSpace(c.Caption)
+	c.Description = strings.TrimSpace(c.Description)
+	if len(c.Caption) > maxCaptionLength {
+		return c, errors.New("caption is too long")
+	}
+	if len(c.Description) > maxDescriptionLength {
+		return c, errors.New("description is too long")
+	}
+	return c, nil
+}
+
+// PutAssetCaption replaces the caption of the asset with keyHash. It is kept
+// apart from the asset's metadata so that reading the file again does not
+// undo the edit.
+func PutAssetCaption(keyHash []byte, c AssetCaption) error {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("assetsLookup")).Get(keyHash) == nil {
+			return ErrAssetNotFound
+		}
+		buf, err := serialise(c)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte("captions")).Put(keyHash, buf); err != nil {
+			return err
+		}
+		return reindexAssetTx(tx, keyHash)
+	})
+}
+
+// GetAssetCaption returns the caption of the asset with keyHash.
+func GetAssetCaption(keyHash []byte) (AssetCaption, error) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var c AssetCaption
+	err = db.View(func(tx *bolt.Tx) error {
+		assetKey := tx.Bucket([]byte("assetsLookup")).Get(keyHash)
+		if assetKey == nil {
+			return ErrAssetNotFound
+		}
+		info, err := deserialiseAssetInfo(tx.Bucket([]byte("assets")).Get(assetKey))
+		if err != nil {
+			return err
+		}
+		c, err = assetCaptionTx(tx, keyHash, info)
+		return err
+	})
+	return c, err
+}
+
+func assetCaptionTx(tx *bolt.Tx, keyHash []byte, info assetInfo) (AssetCaption, error) {
+	var c AssetCaption
+	b := tx.Bucket([]byte("captions"))
+	if b == nil {
+		return AssetCaption{info.Meta.Caption, info.Meta.Description}, nil
+	}
+	buf := b.Get(keyHash)
+	if buf == nil {
+		return AssetCaption{info.Meta.Caption, info.Meta.Description}, nil
+	}
+	err := gob.NewDecoder(bytes.NewBuffer(buf)).Decode(&c)
+	return c, err
+}
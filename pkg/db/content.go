@@ -0,0 +1,84 @@
+package db
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/boltdb/bolt"
+)
+
+// contentIndexBucket maps the SHA-256 of each file to the keys of the assets
+// with that content, so that a photo can be recognised whatever it is
+// called. Each key is "<hash>\x00<keyHash>", so that all the assets for a
+// hash are found with one cursor scan, as in the search index.
+const contentIndexBucket = "contentIndex"
+
+// initContentBucket creates the content index, filling it from every asset
+// if it is new. It replaces "contentHashes", which held one asset per hash.
+func initContentBucket(tx *bolt.Tx) error {
+	if tx.Bucket([]byte(contentIndexBucket)) != nil {
+		return nil
+	}
+	if tx.Bucket([]byte("contentHashes")) != nil {
+		if err := tx.DeleteBucket([]byte("contentHashes")); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.CreateBucket([]byte(contentIndexBucket)); err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("assets")).ForEach(func(k, v []byte) error {
+		info, err := deserialiseAssetInfo(v)
+		if err != nil {
+			return err
+		}
+		return putContentHashTx(tx, info.KeyHash, "", info.Meta.ContentHash)
+	})
+}
+
+func contentIndexKey(hash string, keyHash []byte) []byte {
+	return append([]byte(hash+"\x00"), keyHash...)
+}
+
+// putContentHashTx moves an asset's entry in the content index from old to
+// hash, either of which may be empty.
+func putContentHashTx(tx *bolt.Tx, keyHash []byte, old string, hash string) error {
+	b := tx.Bucket([]byte(contentIndexBucket))
+	if old != "" && old != hash {
+		if err := b.Delete(contentIndexKey(old, keyHash)); err != nil {
+			return err
+		}
+	}
+	if hash == "" {
+		return nil
+	}
+	return b.Put(contentIndexKey(hash, keyHash), []byte{})
+}
+
+// GetAssetKeyForContent returns the key of an asset whose file has the
+// SHA-256 hash, if there is one outside the trash.
+func GetAssetKeyForContent(hash string) ([]byte, bool) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var keyHash []byte
+	err = db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(hash + "\x00")
+		c := tx.Bucket([]byte(contentIndexBucket)).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			key := k[len(prefix):]
+			if tx.Bucket([]byte("assetsLookup")).Get(key) != nil && !isTrashedTx(tx, []byte("all"), key) {
+				keyHash = append([]byte(nil), key...)
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return keyHash, keyHash != nil
+}
@@ -0,0 +1,52 @@
+package db_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"chronoshot/pkg/db"
+	"chronoshot/pkg/db/dbtest"
+)
+
+func TestGetAssetKeyForContentWithCopies(t *testing.T) {
+	dbtest.Open(t)
+	meta := db.AssetMeta{ContentHash: "abc"}
+	first := dbtest.PutAsset("/photos/a.jpg", time.Now(), meta)
+	second := dbtest.PutAsset("/photos/copy/a.jpg", time.Now(), meta)
+
+	for _, trashed := range [][]byte{first, second} {
+		if err := db.PutTrash(db.TrashEntry{AssetKey: string(trashed), Deleted: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		want := first
+		if bytes.Equal(trashed, first) {
+			want = second
+		}
+		if got, ok := db.GetAssetKeyForContent("abc"); !ok || !bytes.Equal(got, want) {
+			t.Errorf("with %s in the trash got %s, %t, want %s", trashed, got, ok, want)
+		}
+		if err := db.RestoreFromTrash(trashed); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Purging one copy leaves the other.
+	if err := db.PutTrash(db.TrashEntry{AssetKey: string(second), Deleted: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PurgeAsset(second); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := db.GetAssetKeyForContent("abc"); !ok || !bytes.Equal(got, first) {
+		t.Errorf("after purging a copy got %s, %t, want %s", got, ok, first)
+	}
+
+	// Nor is the hash kept for content that has changed.
+	if _, err := db.PutAssetMeta(first, db.AssetMeta{ContentHash: "def"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := db.GetAssetKeyForContent("abc"); ok {
+		t.Errorf("got %s for content no asset has", got)
+	}
+}
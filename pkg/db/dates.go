@@ -0,0 +1,157 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Dates corrected by hand are kept in "dateOverrides" by asset key, apart
+// from the asset itself. Its key is made from the date read from the file, so
+// correcting the date leaves the key, and everything stored against it, as it
+// was, and the correction survives the file being indexed again.
+
+// DateShift moves a date by calendar years, months and days, then by
+// Duration.
+type DateShift struct {
+	Years    int
+	Months   int
+	Days     int
+	Duration time.Duration
+}
+
+func (s DateShift) Apply(t time.Time) time.Time {
+	return t.AddDate(s.Years, s.Months, s.Days).Add(s.Duration)
+}
+
+// dateTimeTx returns the date of an asset, corrected if it has been.
+func dateTimeTx(tx *bolt.Tx, info assetInfo) time.Time {
+	b := tx.Bucket([]byte("dateOverrides"))
+	if b == nil {
+		return info.DateTime
+	}
+	buf := b.Get(info.KeyHash)
+	if buf == nil {
+		return info.DateTime
+	}
+	var dateTime time.Time
+	if err := gob.NewDecoder(bytes.NewBuffer(buf)).Decode(&dateTime); err != nil {
+		log.Fatal(err)
+	}
+	return dateTime
+}
+
+// putDateTimeTx corrects the date of an asset, or removes the correction if
+// dateTime is the date read from the file.
+func putDateTimeTx(tx *bolt.Tx, info assetInfo, dateTime time.Time) error {
+	b := tx.Bucket([]byte("dateOverrides"))
+	if dateTime.Equal(info.DateTime) {
+		return b.Delete(info.KeyHash)
+	}
+	buf, err := serialise(dateTime)
+	if err != nil {
+		return err
+	}
+	return b.Put(info.KeyHash, buf)
+}
+
+func assetInfoTx(tx *bolt.Tx, keyHash []byte) (assetInfo, error) {
+	assetKey := tx.Bucket([]byte("assetsLookup")).Get(keyHash)
+	if assetKey == nil {
+		return assetInfo{}, ErrAssetNotFound
+	}
+	return deserialiseAssetInfo(tx.Bucket([]byte("assets")).Get(assetKey))
+}
+
+// PutAssetDateTime corrects the date of the asset with keyHash. The zero time
+// restores the date read from the file.
+func PutAssetDateTime(keyHash []byte, dateTime time.Time) error {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		info, err := assetInfoTx(tx, keyHash)
+		if err != nil {
+			return err
+		}
+		if dateTime.IsZero() {
+			dateTime = info.DateTime
+		}
+		return putDateTimeTx(tx, info, dateTime)
+	})
+	clearAssetKeysCache()
+	return err
+}
+
+// PutFileDateTime replaces the date read from the file of the asset with
+// keyHash, after reading it again. The asset keeps its key.
+func PutFileDateTime(keyHash []byte, dateTime time.Time) error {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		assetKey := tx.Bucket([]byte("assetsLookup")).Get(keyHash)
+		if assetKey == nil {
+			return ErrAssetNotFound
+		}
+		assets := tx.Bucket([]byte("assets"))
+		info, err := deserialiseAssetInfo(assets.Get(assetKey))
+		if err != nil {
+			return err
+		}
+		_, offset := dateTime.Zone()
+		_, oldOffset := info.DateTime.Zone()
+		if dateTime.Equal(info.DateTime) && offset == oldOffset {
+			return nil
+		}
+		corrected := dateTimeTx(tx, info)
+		info.DateTime = dateTime
+		buf, err := serialise(info)
+		if err != nil {
+			return err
+		}
+		if err := assets.Put(assetKey, buf); err != nil {
+			return err
+		}
+		if tx.Bucket([]byte("dateOverrides")).Get(keyHash) == nil {
+			return nil
+		}
+		// Keep the correction, unless the file now agrees with it.
+		return putDateTimeTx(tx, info, corrected)
+	})
+	clearAssetKeysCache()
+	return err
+}
+
+// GetOriginalDateTime returns the date read from the file of the asset with
+// keyHash, whether or not it has been corrected since.
+func GetOriginalDateTime(keyHash []byte) (time.Time, error) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var dateTime time.Time
+	err = db.View(func(tx *bolt.Tx) error {
+		info, err := assetInfoTx(tx, keyHash)
+		dateTime = info.DateTime
+		return err
+	})
+	return dateTime, err
+}
+
+// sortNewestFirst orders assets by date after corrections, keeping the order
+// of assets taken at the same time.
+func sortNewestFirst(assets []Asset) {
+	sort.SliceStable(assets, func(i, k int) bool {
+		return assets[i].DateTime.After(assets[k].DateTime)
+	})
+}
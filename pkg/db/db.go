@@ -6,43 +6,126 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"time"
 
 	"strings"
+	"sync"
 
 	"github.com/boltdb/bolt"
 )
 
 type assetKvp struct {
-	Key       []byte
-	Info      assetInfo
-	Thumbnail []byte
+	Key        []byte
+	Info       assetInfo
+	Thumbnails map[int][]byte
 }
 
 type assetInfo struct {
 	KeyHash  []byte
 	Path     []byte
 	DateTime time.Time
+	Meta     AssetMeta
+}
+
+// AssetMeta is what is known about an asset beyond its path and date, read
+// from the file when it is indexed. Version records how it was read, so that
+// assets indexed by older versions can be read again.
+type AssetMeta struct {
+	Version     int
+	Camera      string
+	Caption     string
+	Description string
+	Keywords    []string // applied as tags
+	Rating      int      // -1 for rejected
+	Label       string
+	Favourite   bool
+	TimeZone    string // where the offset of the date taken came from
+	ContentHash string // SHA-256 of the file, in hex
+	City        string
+	State       string
+	Country     string
+	Location    string // place within the city
 }
 
 type selection struct {
+	UserName   string
 	AssetKey   []byte
 	IsSelected bool
 }
 
+type assetRating struct {
+	UserName string
+	AssetKey []byte
+	Rating   int
+}
+
+type thumbnailsKvp struct {
+	KeyHash    []byte
+	Thumbnails map[int][]byte
+}
+
 var chanPutAsset = make(chan assetKvp)
 var chanPutSelection = make(chan selection)
+var chanPutRating = make(chan assetRating)
+var chanPutThumbnails = make(chan thumbnailsKvp)
+var chanSync = make(chan chan bool)
+var chanClose = make(chan chan bool)
 
 var assetKeysCache = make(map[string][]Asset)
+var assetKeysCacheMutex sync.Mutex
+
+func clearAssetKeysCache() {
+	assetKeysCacheMutex.Lock()
+	assetKeysCache = make(map[string][]Asset)
+	assetKeysCacheMutex.Unlock()
+}
+
+var store *bolt.DB
+var storeMutex sync.RWMutex
+
+var ErrClosed = errors.New("database is closed")
+
+// open returns the database opened by Init.
+func open() (*bolt.DB, error) {
+	storeMutex.RLock()
+	defer storeMutex.RUnlock()
+	if store == nil {
+		return nil, ErrClosed
+	}
+	return store, nil
+}
 
+// ErrInUse is returned by TryInit when another chronoshot, usually the
+// server, holds the database.
+var ErrInUse = errors.New("chronoshot.db is in use, stop the server first")
+
+// Init opens the database, which is held for the life of the process, and
+// starts storing writes. Another chronoshot using the same database must be
+// stopped first.
 func Init() {
-	db, err := bolt.Open("chronoshot.db", 0777, nil)
+	if err := TryInit(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// TryInit is Init, returning ErrInUse rather than exiting if another
+// chronoshot holds the database, so that commands can say what to do
+// instead.
+func TryInit() error {
+	db, err := bolt.Open("chronoshot.db", 0777, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return ErrInUse
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
+	storeMutex.Lock()
+	store = db
+	storeMutex.Unlock()
 
 	err = db.Update(func(tx *bolt.Tx) error {
 		_, err = tx.CreateBucketIfNotExists([]byte("fileIndex"))
@@ -62,23 +145,52 @@ func Init() {
 			return err
 		}
 
-		// xyzzy - when handling multiple selection lists, "selections" and "all" should be replaced
-		_, err = tx.CreateBucketIfNotExists([]byte("selections"))
+		_, err = tx.CreateBucketIfNotExists([]byte("all"))
 		if err != nil {
 			return err
 		}
-		_, err = tx.CreateBucketIfNotExists([]byte("all"))
+		_, err = tx.CreateBucketIfNotExists([]byte("albums"))
 		if err != nil {
 			return err
 		}
-		return nil
+		_, err = tx.CreateBucketIfNotExists([]byte("smartAlbums"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("captions"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("dateOverrides"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("rotations"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte(trashBucket))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("purgedFiles"))
+		if err != nil {
+			return err
+		}
+		if err := initContentBucket(tx); err != nil {
+			return err
+		}
+		if err := initSearchBuckets(tx); err != nil {
+			return err
+		}
+		return initUserBuckets(tx)
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
-	db.Close()
 
 	go writeChannelsMonitor()
+	return nil
 }
 
 func writeChannelsMonitor() {
@@ -88,11 +200,65 @@ func writeChannelsMonitor() {
 			putAsset(assetKvp)
 		case selection := <-chanPutSelection:
 			putSelection(selection)
+		case rating := <-chanPutRating:
+			putRating(rating)
+		case thumbnails := <-chanPutThumbnails:
+			putThumbnails(thumbnails)
+		case done := <-chanSync:
+			close(done)
+		case done := <-chanClose:
+			drainWrites()
+			close(done)
+			return
+		}
+	}
+}
+
+// drainWrites stores any writes already waiting to be sent.
+func drainWrites() {
+	for {
+		select {
+		case assetKvp := <-chanPutAsset:
+			putAsset(assetKvp)
+		case selection := <-chanPutSelection:
+			putSelection(selection)
+		case rating := <-chanPutRating:
+			putRating(rating)
+		case thumbnails := <-chanPutThumbnails:
+			putThumbnails(thumbnails)
+		case done := <-chanSync:
+			close(done)
+		default:
+			return
 		}
 	}
 }
 
-func PutAsset(path []byte, thumbnail []byte, dateTime time.Time) {
+// Sync blocks until every write sent before it has been stored.
+func Sync() {
+	done := make(chan bool)
+	chanSync <- done
+	<-done
+}
+
+// Close stores any pending writes and closes the database. Writes sent after
+// Close block forever, so callers must have stopped first.
+func Close() {
+	done := make(chan bool)
+	chanClose <- done
+	<-done
+
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	if err := store.Close(); err != nil {
+		log.Println("Error closing database:", err)
+	}
+	store = nil
+}
+
+// PutAsset stores a photo along with its thumbnails, keyed by thumbnail size,
+// and returns its key.
+func PutAsset(path []byte, thumbnails map[int][]byte, dateTime time.Time, meta AssetMeta) []byte {
 
 	key := []byte(strings.Join([]string{dateTime.String(), string(path)}, "<#>"))
 
@@ -101,17 +267,16 @@ func PutAsset(path []byte, thumbnail []byte, dateTime time.Time) {
 	keyHash := hasher.Sum(nil)
 	keyHashStr := []byte(base64.URLEncoding.EncodeToString(keyHash))
 
-	chanPutAsset <- assetKvp{key, assetInfo{keyHashStr, path, dateTime}, thumbnail}
+	chanPutAsset <- assetKvp{key, assetInfo{keyHashStr, path, dateTime, meta}, thumbnails}
+	return keyHashStr
 }
 
 func putAsset(kvp assetKvp) {
-	db, err := bolt.Open("chronoshot.db", 0777, nil)
+	db, err := open()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	defer db.Close()
-
 	err = db.Update(func(tx *bolt.Tx) error {
 		hasher := md5.New()
 		hasher.Write(kvp.Key)
@@ -122,6 +287,12 @@ func putAsset(kvp assetKvp) {
 		if err != nil {
 			return err
 		}
+		var oldMeta AssetMeta
+		if buf := bAssets.Get(kvp.Key); buf != nil {
+			if old, err := deserialiseAssetInfo(buf); err == nil {
+				oldMeta = old.Meta
+			}
+		}
 		serialisedAssetInfo, err := serialise(kvp.Info)
 		if err != nil {
 			log.Fatal(err)
@@ -131,11 +302,7 @@ func putAsset(kvp assetKvp) {
 			log.Fatal(err)
 		}
 
-		bThumbnails := tx.Bucket([]byte("thumbnails"))
-		if err != nil {
-			return err
-		}
-		err = bThumbnails.Put(kvp.Key, kvp.Thumbnail)
+		err = putThumbnailsTx(tx, kvp.Key, kvp.Thumbnails)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -168,52 +335,199 @@ func putAsset(kvp assetKvp) {
 			log.Fatal(err)
 		}
 
-		return err
+		if err := putKeywordTagsTx(tx, []byte(keyHashStr), oldMeta.Keywords, kvp.Info.Meta.Keywords); err != nil {
+			return err
+		}
+		if err := putContentHashTx(tx, []byte(keyHashStr), oldMeta.ContentHash, kvp.Info.Meta.ContentHash); err != nil {
+			return err
+		}
+		return indexAssetTx(tx, []byte(keyHashStr), kvp.Info)
 	})
-	db.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
 
+	clearAssetKeysCache()
+}
+
+// PutThumbnails adds or replaces thumbnails for an existing asset.
+func PutThumbnails(keyHash []byte, thumbnails map[int][]byte) {
+	chanPutThumbnails <- thumbnailsKvp{keyHash, thumbnails}
+}
+
+func putThumbnails(kvp thumbnailsKvp) {
+	db, err := open()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	assetKeysCache = make(map[string][]Asset)
+	err = db.Update(func(tx *bolt.Tx) error {
+		assetKey := tx.Bucket([]byte("assetsLookup")).Get(kvp.KeyHash)
+		if assetKey == nil {
+			// Asset has gone since the thumbnails were generated.
+			return nil
+		}
+		return putThumbnailsTx(tx, assetKey, kvp.Thumbnails)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func putThumbnailsTx(tx *bolt.Tx, assetKey []byte, thumbnails map[int][]byte) error {
+	for size, thumbnail := range thumbnails {
+		b, err := tx.CreateBucketIfNotExists(thumbnailBucket(size))
+		if err != nil {
+			return err
+		}
+		err = b.Put(assetKey, thumbnail)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func PutSelection(assetKey []byte, isSelected bool) {
-	chanPutSelection <- selection{assetKey, isSelected}
+// thumbnailBucket names the bucket holding thumbnails of the given size.
+// Assets indexed before thumbnail sizes existed only have the legacy
+// "thumbnails" bucket.
+func thumbnailBucket(size int) []byte {
+	return []byte("thumbnails-" + strconv.Itoa(size))
+}
+
+func thumbnailBucketSize(name []byte) (int, bool) {
+	if !bytes.HasPrefix(name, []byte("thumbnails-")) {
+		return 0, false
+	}
+	size, err := strconv.Atoi(string(name[len("thumbnails-"):]))
+	return size, err == nil
+}
+
+// PutSelection adds or removes an asset from a user's favourites.
+func PutSelection(userName string, assetKey []byte, isSelected bool) {
+	chanPutSelection <- selection{userName, assetKey, isSelected}
 }
 
 func putSelection(s selection) {
-	db, err := bolt.Open("chronoshot.db", 0777, nil)
+	db, err := open()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	defer db.Close()
-
 	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("selections"))
+		return putSelectionTx(tx, s)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	clearAssetKeysCache()
+}
+
+func putSelectionTx(tx *bolt.Tx, s selection) error {
+	b, err := tx.CreateBucketIfNotExists(selectionsBucket(s.UserName))
+	if err != nil {
+		return err
+	}
+
+	if s.IsSelected {
+		serialisedSelection, err := serialise(s.IsSelected)
 		if err != nil {
 			return err
 		}
+		return b.Put(s.AssetKey, serialisedSelection)
+	}
+	return b.Delete(s.AssetKey)
+}
 
-		if s.IsSelected {
-			serialisedSelection, err := serialise(s.IsSelected)
-			if err != nil {
-				log.Fatal(err)
+// PutRating sets a user's rating of an asset, where 0 clears the rating.
+func PutRating(userName string, assetKey []byte, rating int) {
+	chanPutRating <- assetRating{userName, assetKey, rating}
+}
+
+func putRating(r assetRating) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		return putRatingTx(tx, r)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func putRatingTx(tx *bolt.Tx, r assetRating) error {
+	b, err := tx.CreateBucketIfNotExists(ratingsBucket(r.UserName))
+	if err != nil {
+		return err
+	}
+
+	if r.Rating > 0 {
+		return b.Put(r.AssetKey, []byte{byte(r.Rating)})
+	}
+	return b.Delete(r.AssetKey)
+}
+
+func GetRating(userName string, key []byte) int {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var rating int
+	err = db.View(func(tx *bolt.Tx) error {
+		ratings := tx.Bucket(ratingsBucket(userName))
+		if ratings != nil {
+			if v := ratings.Get(key); len(v) == 1 {
+				rating = int(v[0])
 			}
-			return b.Put(s.AssetKey, serialisedSelection)
-		} else {
-			return b.Delete(s.AssetKey)
 		}
+		return nil
 	})
-	db.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
 
+	return rating
+}
+
+// GetRatings returns every rating userName has given, by asset key.
+func GetRatings(userName string) map[string]int {
+	db, err := open()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	assetKeysCache = make(map[string][]Asset)
+	ratings := make(map[string]int)
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ratingsBucket(userName))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if len(v) == 1 {
+				ratings[string(k)] = int(v[0])
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return ratings
+}
+
+// Favourites and ratings are kept per user, in buckets named after them.
+func selectionsBucket(userName string) []byte {
+	return []byte("selections:" + userName)
+}
+
+func ratingsBucket(userName string) []byte {
+	return []byte("ratings:" + userName)
 }
 
 func serialise(key interface{}) ([]byte, error) {
@@ -237,12 +551,13 @@ func deserialiseAssetInfo(key []byte) (assetInfo, error) {
 	return t, nil
 }
 
-func GetThumbnail(key []byte) []byte {
-	db, err := bolt.Open("chronoshot.db", 0777, nil)
+// GetThumbnail returns the smallest stored thumbnail that is at least size
+// pixels square, falling back to the largest available.
+func GetThumbnail(key []byte, size int) []byte {
+	db, err := open()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
 
 	var buf []byte
 	err = db.View(func(tx *bolt.Tx) error {
@@ -250,26 +565,78 @@ func GetThumbnail(key []byte) []byte {
 		assetsLookup := tx.Bucket([]byte("assetsLookup"))
 		assetKey := assetsLookup.Get(key)
 
-		b := tx.Bucket([]byte("thumbnails"))
-		buf = b.Get(assetKey)
+		bestSize, largestSize := 0, 0
+		var largest []byte
+		tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			s, ok := thumbnailBucketSize(name)
+			if !ok {
+				return nil
+			}
+			thumbnail := b.Get(assetKey)
+			if thumbnail == nil {
+				return nil
+			}
+			if s >= size && (buf == nil || s < bestSize) {
+				buf, bestSize = thumbnail, s
+			}
+			if s > largestSize {
+				largest, largestSize = thumbnail, s
+			}
+			return nil
+		})
+		if buf == nil {
+			buf = largest
+		}
+
+		if buf == nil {
+			b := tx.Bucket([]byte("thumbnails"))
+			buf = b.Get(assetKey)
+		}
 		return nil
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// buf is lost on return because of db.Close()
+	// buf is only valid for the life of the transaction
 	bufCopy := make([]byte, len(buf), (cap(buf)+1)*2)
 	copy(bufCopy, buf)
 	return bufCopy
 }
 
+// GetMissingThumbnails returns, for each asset lacking at least one of the
+// given thumbnail sizes, the sizes it is missing.
+func GetMissingThumbnails(sizes []int) map[string][]int {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	missing := make(map[string][]int)
+	err = db.View(func(tx *bolt.Tx) error {
+		assetsLookup := tx.Bucket([]byte("assetsLookup"))
+		return assetsLookup.ForEach(func(keyHash, assetKey []byte) error {
+			for _, size := range sizes {
+				b := tx.Bucket(thumbnailBucket(size))
+				if b == nil || b.Get(assetKey) == nil {
+					missing[string(keyHash)] = append(missing[string(keyHash)], size)
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return missing
+}
+
 func KeyExists(key []byte) bool {
-	db, err := bolt.Open("chronoshot.db", 0777, nil)
+	db, err := open()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
 
 	exists := false
 	err = db.View(func(tx *bolt.Tx) error {
@@ -287,11 +654,10 @@ func KeyExists(key []byte) bool {
 }
 
 func FilePathAdded(filepath []byte) bool {
-	db, err := bolt.Open("chronoshot.db", 0777, nil)
+	db, err := open()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
 
 	var buf []byte
 	err = db.View(func(tx *bolt.Tx) error {
@@ -308,12 +674,38 @@ func FilePathAdded(filepath []byte) bool {
 	return buf != nil
 }
 
+// GetAssetKeyForPath returns the key of the asset indexed from path.
+func GetAssetKeyForPath(path []byte) ([]byte, bool) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var keyHash []byte
+	err = db.View(func(tx *bolt.Tx) error {
+		assetKey := tx.Bucket([]byte("fileIndex")).Get(path)
+		if assetKey == nil {
+			return nil
+		}
+		info, err := deserialiseAssetInfo(tx.Bucket([]byte("assets")).Get(assetKey))
+		if err != nil {
+			return err
+		}
+		keyHash = info.KeyHash
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return keyHash, keyHash != nil
+}
+
 func GetDateTime(key []byte) time.Time {
-	db, err := bolt.Open("chronoshot.db", 0777, nil)
+	db, err := open()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
 
 	var dateTime time.Time
 	err = db.View(func(tx *bolt.Tx) error {
@@ -326,7 +718,7 @@ func GetDateTime(key []byte) time.Time {
 			if err != nil {
 				log.Fatal(err)
 			}
-			dateTime = info.DateTime
+			dateTime = dateTimeTx(tx, info)
 		}
 		return nil
 	})
@@ -337,17 +729,16 @@ func GetDateTime(key []byte) time.Time {
 	return dateTime
 }
 
-func GetIsSelected(key []byte) bool {
-	db, err := bolt.Open("chronoshot.db", 0777, nil)
+func GetIsSelected(userName string, key []byte) bool {
+	db, err := open()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
 
 	var isSelected bool
 	err = db.View(func(tx *bolt.Tx) error {
-		selections := tx.Bucket([]byte("selections"))
-		isSelected = selections.Get(key) != nil
+		selections := tx.Bucket(selectionsBucket(userName))
+		isSelected = selections != nil && selections.Get(key) != nil
 		return nil
 	})
 	if err != nil {
@@ -358,11 +749,10 @@ func GetIsSelected(key []byte) bool {
 }
 
 func GetAssetPath(key []byte) []byte {
-	db, err := bolt.Open("chronoshot.db", 0777, nil)
+	db, err := open()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
 
 	var assetValue []byte
 	err = db.View(func(tx *bolt.Tx) error {
@@ -376,13 +766,23 @@ func GetAssetPath(key []byte) []byte {
 		}
 		assetValue = info.Path
 
+		// The file may be in the trash folder.
+		if buf := tx.Bucket([]byte(trashBucket)).Get(key); buf != nil {
+			entry, err := deserialiseTrashEntry(buf)
+			if err != nil {
+				return err
+			}
+			if moved, ok := entry.Moved[string(info.Path)]; ok {
+				assetValue = []byte(moved)
+			}
+		}
 		return nil
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// assetValue is lost on return because of db.Close()
+	// assetValue is only valid for the life of the transaction
 	assetValueCopy := make([]byte, len(assetValue), (cap(assetValue)+1)*2)
 	copy(assetValueCopy, assetValue)
 	return assetValueCopy
@@ -395,16 +795,17 @@ type Asset struct {
 
 func GetAllAssetKeys(setName []byte) []Asset {
 	strSetName := string(setName)
+	assetKeysCacheMutex.Lock()
 	cachedAssetKeys, ok := assetKeysCache[strSetName]
+	assetKeysCacheMutex.Unlock()
 
 	if ok {
 		return cachedAssetKeys
 	} else {
-		db, err := bolt.Open("chronoshot.db", 0777, nil)
+		db, err := open()
 		if err != nil {
 			log.Fatal(err)
 		}
-		defer db.Close()
 
 		setCount, err := getLengthOfBucket(db, string(setName))
 		setKeys := make([]Asset, setCount)
@@ -412,34 +813,43 @@ func GetAllAssetKeys(setName []byte) []Asset {
 		db.View(func(tx *bolt.Tx) error {
 			bAssets := tx.Bucket([]byte("assets"))
 			bSet := tx.Bucket(setName)
+			if bSet == nil {
+				return nil
+			}
 			i := 1
 
-			// Need to enumerate assets bucket to force date order on the returned set.
+			// Keys start with the date taken, but in whichever zone it was
+			// read in and before any correction, so the order of the assets
+			// bucket is only nearly right.
 			bAssets.ForEach(func(k, v []byte) error {
 				info, err := deserialiseAssetInfo(v)
 				if err != nil {
 					log.Fatal(err)
 				}
-				if bSet.Get(info.KeyHash) != nil {
-					setKeys[setCount-i] = Asset{string(info.KeyHash), info.DateTime}
+				if bSet.Get(info.KeyHash) != nil && !isTrashedTx(tx, setName, info.KeyHash) {
+					setKeys[setCount-i] = Asset{string(info.KeyHash), dateTimeTx(tx, info)}
 					i++
 				}
 				return nil
 			})
+			// Trashed assets leave room at the start.
+			setKeys = setKeys[setCount-i+1:]
+			sortNewestFirst(setKeys)
 			return nil
 		})
 
+		assetKeysCacheMutex.Lock()
 		assetKeysCache[strSetName] = setKeys
+		assetKeysCacheMutex.Unlock()
 		return setKeys
 	}
 }
 
 func GetLengthOfIndex() int {
-	db, err := bolt.Open("chronoshot.db", 0777, nil)
+	db, err := open()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
 
 	lengthOfBucket, err := getLengthOfBucket(db, "assetsLookup")
 
@@ -454,7 +864,9 @@ func getLengthOfBucket(db *bolt.DB, bucketName string) (int, error) {
 	var lengthOfIndex int
 	err := db.View(func(tx *bolt.Tx) error {
 		index := tx.Bucket([]byte(bucketName))
-		lengthOfIndex = index.Stats().KeyN
+		if index != nil {
+			lengthOfIndex = index.Stats().KeyN
+		}
 		return nil
 	})
 	if err != nil {
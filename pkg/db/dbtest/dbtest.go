@@ -0,0 +1,36 @@
+// Package dbtest sets up databases for tests of packages that use db.
+package dbtest
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"chronoshot/pkg/db"
+)
+
+// Open opens a new database in a temporary directory, which becomes the
+// working directory, for the rest of the test.
+func Open(t testing.TB) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	db.Init()
+	t.Cleanup(func() {
+		db.Close()
+		os.Chdir(wd)
+	})
+}
+
+// PutAsset indexes a photo at path, taken at dateTime, without thumbnails,
+// and returns its key once it is stored.
+func PutAsset(path string, dateTime time.Time, meta db.AssetMeta) []byte {
+	key := db.PutAsset([]byte(path), map[int][]byte{}, dateTime, meta)
+	db.Sync()
+	return key
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"log"
+
+	"github.com/boltdb/bolt"
+)
+
+// Rotation turns an asset the right way up in place of its EXIF orientation,
+// for photos whose orientation is missing or wrong.
+type Rotation struct {
+	Degrees int  // clockwise: 0, 90, 180 or 270
+	Flip    bool // mirrored left to right before rotating
+}
+
+// Validate checks r is a quarter turn.
+func (r Rotation) Validate() error {
+	switch r.Degrees {
+	case 0, 90, 180, 270:
+		return nil
+	}
+	return errors.New("rotation must be 0, 90, 180 or 270 degrees")
+}
+
+// PutAssetRotation sets the rotation of the asset with keyHash. A nil
+// rotation goes back to the EXIF orientation.
+func PutAssetRotation(keyHash []byte, r *Rotation) error {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("assetsLookup")).Get(keyHash) == nil {
+			return ErrAssetNotFound
+		}
+		b := tx.Bucket([]byte("rotations"))
+		if r == nil {
+			return b.Delete(keyHash)
+		}
+		buf, err := serialise(*r)
+		if err != nil {
+			return err
+		}
+		return b.Put(keyHash, buf)
+	})
+}
+
+// GetAssetRotation returns the rotation set for the asset with keyHash, if
+// there is one.
+func GetAssetRotation(keyHash []byte) (Rotation, bool) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var r Rotation
+	var ok bool
+	err = db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket([]byte("rotations")).Get(keyHash)
+		if buf == nil {
+			return nil
+		}
+		ok = true
+		return gob.NewDecoder(bytes.NewBuffer(buf)).Decode(&r)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return r, ok
+}
@@ -0,0 +1,333 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/boltdb/bolt"
+)
+
+// The search index maps terms to assets. Each key in "searchIndex" is
+// "<field>:<term>\x00<keyHash>", so that all the assets for a term, or for
+// every term starting with a prefix, are found with one cursor scan.
+// "searchTerms" holds the index keys written for each asset so that they can
+// be removed when the asset is indexed again.
+const (
+	searchIndexBucket = "searchIndex"
+	searchTermsBucket = "searchTerms"
+)
+
+// Search fields. Every term is also indexed under SearchAny.
+const (
+	SearchAny    = "w"
+	SearchFolder = "f"
+	SearchFile   = "n"
+	SearchCamera = "c"
+	SearchTag    = "t"
+	SearchText   = "d" // caption and description
+	SearchLabel  = "l"
+	SearchPlace  = "p" // location, city, state and country
+)
+
+// SearchTerm matches assets with a word in Field starting with Prefix.
+type SearchTerm struct {
+	Field  string
+	Prefix string
+}
+
+// initSearchBuckets creates the search buckets, indexing every asset if
+// they are new.
+func initSearchBuckets(tx *bolt.Tx) error {
+	if tx.Bucket([]byte(searchTermsBucket)) != nil {
+		return nil
+	}
+	if _, err := tx.CreateBucketIfNotExists([]byte(searchIndexBucket)); err != nil {
+		return err
+	}
+	if _, err := tx.CreateBucket([]byte(searchTermsBucket)); err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("assets")).ForEach(func(k, v []byte) error {
+		info, err := deserialiseAssetInfo(v)
+		if err != nil {
+			return err
+		}
+		return indexAssetTx(tx, info.KeyHash, info)
+	})
+}
+
+// Tokenise splits s into the lower case words used by the search index.
+func Tokenise(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// searchFieldsTx returns the text indexed for an asset, by field.
+func searchFieldsTx(tx *bolt.Tx, keyHash []byte, info assetInfo) (map[string][]string, error) {
+	path := filepath.ToSlash(string(info.Path))
+	dir, file := filepath.Split(path)
+	file = strings.TrimSuffix(file, filepath.Ext(file))
+	caption, err := assetCaptionTx(tx, keyHash, info)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]string{
+		SearchFolder: {dir},
+		SearchFile:   {file},
+		SearchCamera: {info.Meta.Camera},
+		SearchTag:    assetTagsTx(tx, keyHash),
+		SearchText:   {caption.Caption, caption.Description},
+		SearchLabel:  {info.Meta.Label},
+		SearchPlace:  {info.Meta.Location, info.Meta.City, info.Meta.State, info.Meta.Country},
+	}, nil
+}
+
+// indexAssetTx replaces the search terms for the asset with keyHash.
+func indexAssetTx(tx *bolt.Tx, keyHash []byte, info assetInfo) error {
+	index := tx.Bucket([]byte(searchIndexBucket))
+	terms := tx.Bucket([]byte(searchTermsBucket))
+	if index == nil || terms == nil {
+		// Still being created by Init, which indexes everything.
+		return nil
+	}
+
+	if buf := terms.Get(keyHash); buf != nil {
+		var old []string
+		if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&old); err != nil {
+			return err
+		}
+		for _, k := range old {
+			if err := index.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+	}
+
+	fields, err := searchFieldsTx(tx, keyHash, info)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]bool)
+	for field, texts := range fields {
+		for _, text := range texts {
+			for _, word := range Tokenise(text) {
+				keys[field+":"+word+"\x00"+string(keyHash)] = true
+				keys[SearchAny+":"+word+"\x00"+string(keyHash)] = true
+			}
+		}
+	}
+	var indexKeys []string
+	for k := range keys {
+		if err := index.Put([]byte(k), []byte{}); err != nil {
+			return err
+		}
+		indexKeys = append(indexKeys, k)
+	}
+	sort.Strings(indexKeys)
+
+	buf, err := serialise(indexKeys)
+	if err != nil {
+		return err
+	}
+	return terms.Put(keyHash, buf)
+}
+
+// reindexAssetTx indexes the asset with keyHash again, after something it is
+// searched by has changed.
+func reindexAssetTx(tx *bolt.Tx, keyHash []byte) error {
+	assetKey := tx.Bucket([]byte("assetsLookup")).Get(keyHash)
+	if assetKey == nil {
+		return ErrAssetNotFound
+	}
+	info, err := deserialiseAssetInfo(tx.Bucket([]byte("assets")).Get(assetKey))
+	if err != nil {
+		return err
+	}
+	return indexAssetTx(tx, keyHash, info)
+}
+
+// matchTermTx returns the keyHashes of assets with a word matching term.
+func matchTermTx(tx *bolt.Tx, term SearchTerm) map[string]bool {
+	matches := make(map[string]bool)
+	prefix := []byte(term.Field + ":" + term.Prefix)
+	c := tx.Bucket([]byte(searchIndexBucket)).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if i := bytes.IndexByte(k, 0); i >= 0 {
+			matches[string(k[i+1:])] = true
+		}
+	}
+	return matches
+}
+
+// Search returns the assets in the set held in setName that match every
+// term, newest first as GetAllAssetKeys. With no terms it matches the whole
+// set.
+func Search(setName []byte, terms []SearchTerm) []Asset {
+	if len(terms) == 0 {
+		return GetAllAssetKeys(setName)
+	}
+
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var assets []Asset
+	err = db.View(func(tx *bolt.Tx) error {
+		bSet := tx.Bucket(setName)
+		if bSet == nil {
+			return nil
+		}
+
+		var matches map[string]bool
+		for _, term := range terms {
+			m := matchTermTx(tx, term)
+			if matches != nil {
+				for keyHash := range matches {
+					if !m[keyHash] {
+						delete(matches, keyHash)
+					}
+				}
+			} else {
+				matches = m
+			}
+			if len(matches) == 0 {
+				return nil
+			}
+		}
+
+		// Asset keys start with the date taken, so sorting them gives
+		// nearly the order of the assets bucket, which sortNewestFirst
+		// finishes.
+		lookup := tx.Bucket([]byte("assetsLookup"))
+		var assetKeys []string
+		for keyHash := range matches {
+			if bSet.Get([]byte(keyHash)) == nil || isTrashedTx(tx, setName, []byte(keyHash)) {
+				continue
+			}
+			if assetKey := lookup.Get([]byte(keyHash)); assetKey != nil {
+				assetKeys = append(assetKeys, string(assetKey))
+			}
+		}
+		sort.Sort(sort.Reverse(sort.StringSlice(assetKeys)))
+
+		bAssets := tx.Bucket([]byte("assets"))
+		for _, assetKey := range assetKeys {
+			info, err := deserialiseAssetInfo(bAssets.Get([]byte(assetKey)))
+			if err != nil {
+				return err
+			}
+			assets = append(assets, Asset{string(info.KeyHash), dateTimeTx(tx, info)})
+		}
+		sortNewestFirst(assets)
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return assets
+}
+
+// PutAssetMeta replaces the metadata of the asset with keyHash, returning
+// what it was. Keywords that were added or removed are added to or removed
+// from the asset's tags. If fileChanged, because the file or its sidecar was
+// written since the metadata was last read, a caption that has changed
+// replaces any edit made here. Reading an unchanged file again, as after
+// the reader itself changes, leaves the edit alone.
+func PutAssetMeta(keyHash []byte, meta AssetMeta, fileChanged bool) (AssetMeta, error) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var old AssetMeta
+	err = db.Update(func(tx *bolt.Tx) error {
+		assetKey := tx.Bucket([]byte("assetsLookup")).Get(keyHash)
+		if assetKey == nil {
+			return ErrAssetNotFound
+		}
+		assets := tx.Bucket([]byte("assets"))
+		info, err := deserialiseAssetInfo(assets.Get(assetKey))
+		if err != nil {
+			return err
+		}
+		old = info.Meta
+		info.Meta = meta
+		buf, err := serialise(info)
+		if err != nil {
+			return err
+		}
+		if err := assets.Put(assetKey, buf); err != nil {
+			return err
+		}
+		if fileChanged && (old.Caption != meta.Caption || old.Description != meta.Description) {
+			if err := tx.Bucket([]byte("captions")).Delete(keyHash); err != nil {
+				return err
+			}
+		}
+		if err := putKeywordTagsTx(tx, keyHash, old.Keywords, meta.Keywords); err != nil {
+			return err
+		}
+		if err := putContentHashTx(tx, keyHash, old.ContentHash, meta.ContentHash); err != nil {
+			return err
+		}
+		return indexAssetTx(tx, keyHash, info)
+	})
+	clearAssetKeysCache()
+	return old, err
+}
+
+// GetAssetMeta returns the metadata of the asset with keyHash.
+func GetAssetMeta(keyHash []byte) (AssetMeta, error) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var meta AssetMeta
+	err = db.View(func(tx *bolt.Tx) error {
+		assetKey := tx.Bucket([]byte("assetsLookup")).Get(keyHash)
+		if assetKey == nil {
+			return ErrAssetNotFound
+		}
+		info, err := deserialiseAssetInfo(tx.Bucket([]byte("assets")).Get(assetKey))
+		meta = info.Meta
+		return err
+	})
+	return meta, err
+}
+
+// GetAssetsWithOldMeta returns the keyHashes of assets whose metadata was
+// read by a version older than version.
+func GetAssetsWithOldMeta(version int) [][]byte {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var keyHashes [][]byte
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("assets")).ForEach(func(k, v []byte) error {
+			info, err := deserialiseAssetInfo(v)
+			if err != nil {
+				return err
+			}
+			if info.Meta.Version < version {
+				keyHashes = append(keyHashes, info.KeyHash)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return keyHashes
+}
@@ -0,0 +1,43 @@
+package db_test
+
+import (
+	"testing"
+	"time"
+
+	"chronoshot/pkg/db"
+	"chronoshot/pkg/db/dbtest"
+)
+
+func TestPutAssetMetaKeepsCaptionEdit(t *testing.T) {
+	dbtest.Open(t)
+	key := dbtest.PutAsset("/photos/a.jpg", time.Now(), db.AssetMeta{Version: 1, Caption: "From EXIF"})
+	edit := db.AssetCaption{Caption: "Edited"}
+	if err := db.PutAssetCaption(key, edit); err != nil {
+		t.Fatal(err)
+	}
+
+	// A newer reader finds a different caption in the same file.
+	if _, err := db.PutAssetMeta(key, db.AssetMeta{Version: 2}, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustCaption(t, key); got != edit {
+		t.Errorf("caption %+v after reading the file again, want %+v", got, edit)
+	}
+
+	// The file itself gains a caption.
+	if _, err := db.PutAssetMeta(key, db.AssetMeta{Version: 2, Caption: "From sidecar"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mustCaption(t, key), (db.AssetCaption{Caption: "From sidecar"}); got != want {
+		t.Errorf("caption %+v after the file changed, want %+v", got, want)
+	}
+}
+
+func mustCaption(t *testing.T, key []byte) db.AssetCaption {
+	t.Helper()
+	c, err := db.GetAssetCaption(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
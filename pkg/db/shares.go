@@ -0,0 +1,156 @@
+package db
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var ErrShareNotFound = errors.New("share link not found")
+
+// ShareLink gives anyone holding its token access to a single asset or to a
+// set, as seen by the user who created it.
+type ShareLink struct {
+	ID            string
+	Owner         string
+	AssetKey      string // set for a single asset
+	Set           string // set for a whole set, e.g. "album:<id>"
+	Expires       time.Time
+	PasswordHash  []byte
+	AllowDownload bool
+	Created       time.Time
+}
+
+// Expired reports whether the link has passed its expiry, if it has one.
+func (s ShareLink) Expired() bool {
+	return !s.Expires.IsZero() && time.Now().After(s.Expires)
+}
+
+func deserialiseShareLink(buf []byte) (ShareLink, error) {
+	var s ShareLink
+	err := gob.NewDecoder(bytes.NewBuffer(buf)).Decode(&s)
+	return s, err
+}
+
+// GetSecret returns a random key stored under name, creating it on first use.
+func GetSecret(name string) []byte {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var secret []byte
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("secrets"))
+		if err != nil {
+			return err
+		}
+		if v := b.Get([]byte(name)); v != nil {
+			secret = append([]byte(nil), v...)
+			return nil
+		}
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		return b.Put([]byte(name), secret)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return secret
+}
+
+func PutShareLink(s ShareLink) error {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("shares"))
+		if err != nil {
+			return err
+		}
+		serialisedShareLink, err := serialise(s)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(s.ID), serialisedShareLink)
+	})
+}
+
+func GetShareLink(id string) (ShareLink, error) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var s ShareLink
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("shares"))
+		if b == nil {
+			return ErrShareNotFound
+		}
+		buf := b.Get([]byte(id))
+		if buf == nil {
+			return ErrShareNotFound
+		}
+		s, err = deserialiseShareLink(buf)
+		return err
+	})
+	return s, err
+}
+
+// GetShareLinks returns the unexpired links created by owner, or by anyone if
+// owner is empty.
+func GetShareLinks(owner string) []ShareLink {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var links []ShareLink
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("shares"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			s, err := deserialiseShareLink(v)
+			if err != nil {
+				return err
+			}
+			if (owner == "" || s.Owner == owner) && !s.Expired() {
+				links = append(links, s)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return links
+}
+
+func DeleteShareLink(id string) error {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("shares"))
+		if b == nil || b.Get([]byte(id)) == nil {
+			return ErrShareNotFound
+		}
+		return b.Delete([]byte(id))
+	})
+}
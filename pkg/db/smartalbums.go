@@ -0,0 +1,161 @@
+package db
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// A SmartAlbum is a saved search. Its assets are not stored but found each
+// time it is viewed, as its owner would see them, so it stays up to date.
+type SmartAlbum struct {
+	ID      string
+	Name    string
+	Owner   string
+	Query   string
+	Created time.Time
+}
+
+func deserialiseSmartAlbum(buf []byte) (SmartAlbum, error) {
+	var a SmartAlbum
+	err := gob.NewDecoder(bytes.NewBuffer(buf)).Decode(&a)
+	return a, err
+}
+
+func putSmartAlbumTx(tx *bolt.Tx, album SmartAlbum) error {
+	serialisedAlbum, err := serialise(album)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("smartAlbums")).Put([]byte(album.ID), serialisedAlbum)
+}
+
+func CreateSmartAlbum(owner string, name string, query string) (SmartAlbum, error) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return SmartAlbum{}, err
+	}
+	album := SmartAlbum{
+		ID:      hex.EncodeToString(id),
+		Name:    name,
+		Owner:   owner,
+		Query:   query,
+		Created: time.Now(),
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		return putSmartAlbumTx(tx, album)
+	})
+	return album, err
+}
+
+// GetSmartAlbum returns a smart album, which only its owner can see.
+func GetSmartAlbum(userName string, id string) (SmartAlbum, error) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var album SmartAlbum
+	err = db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket([]byte("smartAlbums")).Get([]byte(id))
+		if buf == nil {
+			return ErrAlbumNotFound
+		}
+		album, err = deserialiseSmartAlbum(buf)
+		if err == nil && album.Owner != userName {
+			return ErrAlbumNotFound
+		}
+		return err
+	})
+	return album, err
+}
+
+// GetSmartAlbums returns the smart albums userName owns.
+func GetSmartAlbums(userName string) []SmartAlbum {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var albums []SmartAlbum
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("smartAlbums")).ForEach(func(k, v []byte) error {
+			album, err := deserialiseSmartAlbum(v)
+			if err != nil {
+				return err
+			}
+			if album.Owner == userName {
+				albums = append(albums, album)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return albums
+}
+
+// UpdateSmartAlbum applies change to a smart album owned by userName.
+func UpdateSmartAlbum(userName string, id string, change func(*SmartAlbum) error) (SmartAlbum, error) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var album SmartAlbum
+	err = db.Update(func(tx *bolt.Tx) error {
+		buf := tx.Bucket([]byte("smartAlbums")).Get([]byte(id))
+		if buf == nil {
+			return ErrAlbumNotFound
+		}
+		album, err = deserialiseSmartAlbum(buf)
+		if err != nil {
+			return err
+		}
+		if album.Owner != userName {
+			return ErrAlbumNotFound
+		}
+		if err := change(&album); err != nil {
+			return err
+		}
+		return putSmartAlbumTx(tx, album)
+	})
+	return album, err
+}
+
+// DeleteSmartAlbum removes a smart album owned by userName.
+func DeleteSmartAlbum(userName string, id string) error {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("smartAlbums"))
+		buf := b.Get([]byte(id))
+		if buf == nil {
+			return ErrAlbumNotFound
+		}
+		album, err := deserialiseSmartAlbum(buf)
+		if err != nil {
+			return err
+		}
+		if album.Owner != userName {
+			return ErrAlbumNotFound
+		}
+		return b.Delete([]byte(id))
+	})
+}
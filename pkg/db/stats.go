@@ -0,0 +1,96 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Stats describes the database file and the transactions run against it
+// since Init.
+type Stats struct {
+	Size        int64 // bytes on disk
+	FreePages   int
+	TxN         int // read transactions started
+	OpenTxN     int // read transactions currently open
+	PageAllocs  int // bytes allocated by transactions
+	Writes      int // pages written
+	WriteTime   time.Duration
+	Rebalances  int
+	Spills      int
+	CursorCount int
+}
+
+func GetStats() (Stats, error) {
+	db, err := open()
+	if err != nil {
+		return Stats{}, err
+	}
+	info, err := os.Stat(db.Path())
+	if err != nil {
+		return Stats{}, err
+	}
+
+	s := db.Stats()
+	return Stats{
+		Size:        info.Size(),
+		FreePages:   s.FreePageN,
+		TxN:         s.TxN,
+		OpenTxN:     s.OpenTxN,
+		PageAllocs:  s.TxStats.PageAlloc,
+		Writes:      s.TxStats.Write,
+		WriteTime:   s.TxStats.WriteTime,
+		Rebalances:  s.TxStats.Rebalance,
+		Spills:      s.TxStats.Spill,
+		CursorCount: s.TxStats.CursorCount,
+	}, nil
+}
+
+// GetSetSizes returns the number of assets in every set, named by bucket,
+// e.g. "all", "selections:<user>", "album:<id>" or "tag:<name>".
+func GetSetSizes() (map[string]int, error) {
+	db, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make(map[string]int)
+	err = db.View(func(tx *bolt.Tx) error {
+		trash := tx.Bucket([]byte(trashBucket))
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			setName := string(name)
+			if setName == "all" || strings.HasPrefix(setName, "selections:") || strings.HasPrefix(setName, "album:") || strings.HasPrefix(setName, "tag:") {
+				sizes[setName] = b.Stats().KeyN
+				// Trashed assets are not counted.
+				trash.ForEach(func(keyHash, _ []byte) error {
+					if b.Get(keyHash) != nil {
+						sizes[setName]--
+					}
+					return nil
+				})
+			}
+			if setName == trashBucket {
+				sizes[setName] = b.Stats().KeyN
+			}
+			return nil
+		})
+	})
+	return sizes, err
+}
+
+// Ping checks that the database is open and readable.
+func Ping() error {
+	db, err := open()
+	if err != nil {
+		return err
+	}
+	return db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("assets")) == nil {
+			return errors.New("assets bucket missing")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,200 @@
+package db
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"unicode"
+
+	"github.com/boltdb/bolt"
+)
+
+var ErrAssetNotFound = errors.New("asset not found")
+
+// Longest tag name accepted, in bytes.
+const maxTagLength = 100
+
+// Tags are shared by all users. Each has its own bucket, keyed like "all",
+// so that a tag can be used as a set.
+func tagBucket(tag string) []byte {
+	return []byte("tag:" + tag)
+}
+
+// NormaliseTag trims tag and checks it is usable as a name.
+func NormaliseTag(tag string) (string, error) {
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return "", errors.New("tag is empty")
+	}
+	if len(tag) > maxTagLength {
+		return "", errors.New("tag is too long")
+	}
+	if strings.IndexFunc(tag, unicode.IsControl) >= 0 {
+		return "", errors.New("tag contains control characters")
+	}
+	return tag, nil
+}
+
+// PutAssetTag adds tag to, or removes it from, the asset with keyHash.
+func PutAssetTag(keyHash []byte, tag string, add bool) error {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		return putAssetTagTx(tx, keyHash, tag, add)
+	})
+	clearAssetKeysCache()
+	return err
+}
+
+func putAssetTagTx(tx *bolt.Tx, keyHash []byte, tag string, add bool) error {
+	assetKey := tx.Bucket([]byte("assetsLookup")).Get(keyHash)
+	if assetKey == nil {
+		return ErrAssetNotFound
+	}
+	if !add {
+		b := tx.Bucket(tagBucket(tag))
+		if b == nil {
+			return nil
+		}
+		if err := b.Delete(keyHash); err != nil {
+			return err
+		}
+		if k, _ := b.Cursor().First(); k == nil {
+			if err := tx.DeleteBucket(tagBucket(tag)); err != nil {
+				return err
+			}
+		}
+		return reindexAssetTx(tx, keyHash)
+	}
+	b, err := tx.CreateBucketIfNotExists(tagBucket(tag))
+	if err != nil {
+		return err
+	}
+	if err := b.Put(keyHash, assetKey); err != nil {
+		return err
+	}
+	return reindexAssetTx(tx, keyHash)
+}
+
+// putKeywordTagsTx brings an asset's tags up to date with keywords read from
+// its file, which were previously old. Tags added or removed here since are
+// left alone unless the keyword itself changes.
+func putKeywordTagsTx(tx *bolt.Tx, keyHash []byte, old []string, keywords []string) error {
+	previous := keywordTags(old)
+	current := keywordTags(keywords)
+	for tag := range previous {
+		if !current[tag] {
+			if err := putAssetTagTx(tx, keyHash, tag, false); err != nil {
+				return err
+			}
+		}
+	}
+	for tag := range current {
+		if !previous[tag] {
+			if err := putAssetTagTx(tx, keyHash, tag, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func keywordTags(keywords []string) map[string]bool {
+	tags := make(map[string]bool)
+	for _, keyword := range keywords {
+		if tag, err := NormaliseTag(keyword); err == nil {
+			tags[tag] = true
+		}
+	}
+	return tags
+}
+
+// GetAssetTags returns the tags on the asset with keyHash, sorted.
+func GetAssetTags(keyHash []byte) []string {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var tags []string
+	err = db.View(func(tx *bolt.Tx) error {
+		tags = assetTagsTx(tx, keyHash)
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return tags
+}
+
+func assetTagsTx(tx *bolt.Tx, keyHash []byte) []string {
+	tags := []string{}
+	c := tx.Cursor()
+	prefix := []byte("tag:")
+	for k, _ := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), "tag:"); k, _ = c.Next() {
+		if tx.Bucket(k).Get(keyHash) != nil {
+			tags = append(tags, strings.TrimPrefix(string(k), "tag:"))
+		}
+	}
+	return tags
+}
+
+// GetTaggedAssets returns the keys of every asset with at least one tag.
+func GetTaggedAssets() map[string]bool {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tagged := make(map[string]bool)
+	err = db.View(func(tx *bolt.Tx) error {
+		c := tx.Cursor()
+		for k, _ := c.Seek([]byte("tag:")); k != nil && strings.HasPrefix(string(k), "tag:"); k, _ = c.Next() {
+			tx.Bucket(k).ForEach(func(keyHash, _ []byte) error {
+				tagged[string(keyHash)] = true
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return tagged
+}
+
+// GetTags returns every tag in use and the number of assets it is on, not
+// counting those in the trash.
+func GetTags() map[string]int {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tags := make(map[string]int)
+	err = db.View(func(tx *bolt.Tx) error {
+		c := tx.Cursor()
+		for k, _ := c.Seek([]byte("tag:")); k != nil && strings.HasPrefix(string(k), "tag:"); k, _ = c.Next() {
+			b := tx.Bucket(k)
+			count := b.Stats().KeyN
+			tx.Bucket([]byte(trashBucket)).ForEach(func(keyHash, _ []byte) error {
+				if b.Get(keyHash) != nil {
+					count--
+				}
+				return nil
+			})
+			tags[strings.TrimPrefix(string(k), "tag:")] = count
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return tags
+}
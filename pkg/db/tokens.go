@@ -0,0 +1,225 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var ErrTokenNotFound = errors.New("api token not found")
+
+// Scopes an API token can be granted.
+const (
+	ScopeRead  = "read"  // view assets, sets and albums
+	ScopeWrite = "write" // change selections, ratings, albums and share links
+	ScopeAdmin = "admin" // use /admin/, if the user is an admin
+)
+
+// APIToken lets scripts act as a user without signing in. Like sessions,
+// tokens are stored under a hash; the token itself is only shown once.
+type APIToken struct {
+	ID       string
+	UserName string
+	Name     string
+	Scopes   []string
+	Created  time.Time
+	Expires  time.Time // zero for never
+	LastUsed time.Time
+}
+
+// HasScope reports whether the token was granted scope.
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the token has passed its expiry, if it has one.
+func (t APIToken) Expired() bool {
+	return !t.Expires.IsZero() && time.Now().After(t.Expires)
+}
+
+func deserialiseAPIToken(buf []byte) (APIToken, error) {
+	var t APIToken
+	err := gob.NewDecoder(bytes.NewBuffer(buf)).Decode(&t)
+	return t, err
+}
+
+func PutAPIToken(tokenHash []byte, t APIToken) error {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("apiTokens"))
+		if err != nil {
+			return err
+		}
+		serialisedToken, err := serialise(t)
+		if err != nil {
+			return err
+		}
+		return b.Put(tokenHash, serialisedToken)
+	})
+}
+
+// GetAPIToken returns the unexpired token stored under tokenHash.
+func GetAPIToken(tokenHash []byte) (APIToken, bool) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var t APIToken
+	found := false
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("apiTokens"))
+		if b == nil {
+			return nil
+		}
+		buf := b.Get(tokenHash)
+		if buf == nil {
+			return nil
+		}
+		t, err = deserialiseAPIToken(buf)
+		found = err == nil && !t.Expired()
+		return err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return t, found
+}
+
+// TouchAPIToken records that the token stored under tokenHash was used at
+// when. To save a write per request, uses within a minute of the last one
+// recorded are not, which is checked in a read-only transaction first.
+func TouchAPIToken(tokenHash []byte, when time.Time) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stale := false
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("apiTokens"))
+		if b == nil {
+			return nil
+		}
+		buf := b.Get(tokenHash)
+		if buf == nil {
+			return nil
+		}
+		t, err := deserialiseAPIToken(buf)
+		if err != nil {
+			return err
+		}
+		stale = when.Sub(t.LastUsed) >= time.Minute
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !stale {
+		return
+	}
+
+	// Checked again, as another request may have got here first.
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("apiTokens"))
+		if b == nil {
+			return nil
+		}
+		buf := b.Get(tokenHash)
+		if buf == nil {
+			return nil
+		}
+		t, err := deserialiseAPIToken(buf)
+		if err != nil {
+			return err
+		}
+		if when.Sub(t.LastUsed) < time.Minute {
+			return nil
+		}
+		t.LastUsed = when
+		serialisedToken, err := serialise(t)
+		if err != nil {
+			return err
+		}
+		return b.Put(tokenHash, serialisedToken)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// GetAPITokens returns the tokens belonging to userName, including expired
+// ones so they can be seen and tidied up.
+func GetAPITokens(userName string) []APIToken {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var tokens []APIToken
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("apiTokens"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			t, err := deserialiseAPIToken(v)
+			if err != nil {
+				return err
+			}
+			if t.UserName == userName {
+				tokens = append(tokens, t)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return tokens
+}
+
+// DeleteAPIToken revokes one of userName's tokens by its ID.
+func DeleteAPIToken(userName string, id string) error {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("apiTokens"))
+		if b == nil {
+			return ErrTokenNotFound
+		}
+		var tokenHash []byte
+		err := b.ForEach(func(k, v []byte) error {
+			t, err := deserialiseAPIToken(v)
+			if err == nil && t.ID == id && t.UserName == userName {
+				tokenHash = append([]byte(nil), k...)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if tokenHash == nil {
+			return ErrTokenNotFound
+		}
+		return b.Delete(tokenHash)
+	})
+}
@@ -0,0 +1,269 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var ErrNotInTrash = errors.New("asset is not in the trash")
+
+// Trashed assets stay where they are in every bucket, so that they can be
+// restored as they were, but are left out of every set other than "trash",
+// which is keyed like "all".
+const trashBucket = "trash"
+
+// TrashEntry records an asset put in the trash.
+type TrashEntry struct {
+	AssetKey  string
+	Deleted   time.Time
+	DeletedBy string
+	Moved     map[string]string `json:",omitempty"` // the asset's files moved to the trash folder, from where they were
+}
+
+func deserialiseTrashEntry(buf []byte) (TrashEntry, error) {
+	var e TrashEntry
+	err := gob.NewDecoder(bytes.NewBuffer(buf)).Decode(&e)
+	return e, err
+}
+
+// PutTrash puts the asset with e.AssetKey in the trash.
+func PutTrash(e TrashEntry) error {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("assetsLookup")).Get([]byte(e.AssetKey)) == nil {
+			return ErrAssetNotFound
+		}
+		buf, err := serialise(e)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(trashBucket)).Put([]byte(e.AssetKey), buf)
+	})
+	clearAssetKeysCache()
+	return err
+}
+
+// GetTrashEntry returns how the asset with keyHash was put in the trash, if
+// it is there.
+func GetTrashEntry(keyHash []byte) (TrashEntry, bool) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var e TrashEntry
+	var ok bool
+	err = db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket([]byte(trashBucket)).Get(keyHash)
+		if buf == nil {
+			return nil
+		}
+		ok = true
+		e, err = deserialiseTrashEntry(buf)
+		return err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return e, ok
+}
+
+// GetTrash returns everything in the trash.
+func GetTrash() []TrashEntry {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	entries := []TrashEntry{}
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(trashBucket)).ForEach(func(k, v []byte) error {
+			e, err := deserialiseTrashEntry(v)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return entries
+}
+
+// RestoreFromTrash takes the asset with keyHash out of the trash.
+func RestoreFromTrash(keyHash []byte) error {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(trashBucket))
+		if b.Get(keyHash) == nil {
+			return ErrNotInTrash
+		}
+		return b.Delete(keyHash)
+	})
+	clearAssetKeysCache()
+	return err
+}
+
+// isTrashedTx reports whether an asset should be left out of setName.
+func isTrashedTx(tx *bolt.Tx, setName []byte, keyHash []byte) bool {
+	if string(setName) == trashBucket {
+		return false
+	}
+	b := tx.Bucket([]byte(trashBucket))
+	return b != nil && b.Get(keyHash) != nil
+}
+
+// PurgeAsset removes every trace of the asset with keyHash, which must be
+// in the trash. Unless its file was moved to the trash folder, its path is
+// remembered so that the file is not indexed again while it is unchanged.
+func PurgeAsset(keyHash []byte) error {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		buf := tx.Bucket([]byte(trashBucket)).Get(keyHash)
+		if buf == nil {
+			return ErrNotInTrash
+		}
+		entry, err := deserialiseTrashEntry(buf)
+		if err != nil {
+			return err
+		}
+		assetKey := tx.Bucket([]byte("assetsLookup")).Get(keyHash)
+		if assetKey == nil {
+			return tx.Bucket([]byte(trashBucket)).Delete(keyHash)
+		}
+		assetKey = append([]byte(nil), assetKey...)
+		info, err := deserialiseAssetInfo(tx.Bucket([]byte("assets")).Get(assetKey))
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Bucket([]byte("assets")).Delete(assetKey); err != nil {
+			return err
+		}
+		if bytes.Equal(tx.Bucket([]byte("fileIndex")).Get(info.Path), assetKey) {
+			if err := tx.Bucket([]byte("fileIndex")).Delete(info.Path); err != nil {
+				return err
+			}
+		}
+		if len(entry.Moved) == 0 {
+			buf, err := serialise(time.Now())
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket([]byte("purgedFiles")).Put(info.Path, buf); err != nil {
+				return err
+			}
+		}
+		if err := putContentHashTx(tx, keyHash, info.Meta.ContentHash, ""); err != nil {
+			return err
+		}
+
+		if terms := tx.Bucket([]byte(searchTermsBucket)).Get(keyHash); terms != nil {
+			var indexKeys []string
+			if err := gob.NewDecoder(bytes.NewReader(terms)).Decode(&indexKeys); err != nil {
+				return err
+			}
+			for _, k := range indexKeys {
+				if err := tx.Bucket([]byte(searchIndexBucket)).Delete([]byte(k)); err != nil {
+					return err
+				}
+			}
+		}
+
+		if b := tx.Bucket([]byte("shares")); b != nil {
+			var shares [][]byte
+			err := b.ForEach(func(k, v []byte) error {
+				if s, err := deserialiseShareLink(v); err == nil && s.AssetKey == string(keyHash) {
+					shares = append(shares, k)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, k := range shares {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Buckets are listed first, as some are deleted once empty.
+		var names [][]byte
+		tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			names = append(names, name)
+			return nil
+		})
+		for _, name := range names {
+			s := string(name)
+			b := tx.Bucket(name)
+			var err error
+			switch {
+			case s == "thumbnails", strings.HasPrefix(s, "thumbnails-"):
+				err = b.Delete(assetKey)
+			case s == "assetsLookup", s == "all", s == trashBucket,
+				s == searchTermsBucket, s == "captions", s == "dateOverrides", s == "rotations",
+				strings.HasPrefix(s, "selections:"), strings.HasPrefix(s, "ratings:"),
+				strings.HasPrefix(s, "album:"):
+				err = b.Delete(keyHash)
+			case strings.HasPrefix(s, "tag:"):
+				if err = b.Delete(keyHash); err == nil {
+					if k, _ := b.Cursor().First(); k == nil {
+						err = tx.DeleteBucket(name)
+					}
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	clearAssetKeysCache()
+	return err
+}
+
+// IsFilePurged reports whether the file at path belongs to a purged asset,
+// and has not been modified since it was purged.
+func IsFilePurged(path []byte, modTime time.Time) bool {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var purged time.Time
+	err = db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket([]byte("purgedFiles")).Get(path)
+		if buf == nil {
+			return nil
+		}
+		return gob.NewDecoder(bytes.NewBuffer(buf)).Decode(&purged)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return !purged.IsZero() && modTime.Before(purged)
+}
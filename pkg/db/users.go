@@ -0,0 +1,251 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var ErrUserExists = errors.New("user already exists")
+var ErrUserNotFound = errors.New("user not found")
+
+type User struct {
+	Name         string
+	PasswordHash []byte
+	IsAdmin      bool
+	Created      time.Time
+}
+
+type Session struct {
+	UserName string
+	Expires  time.Time
+}
+
+func initUserBuckets(tx *bolt.Tx) error {
+	_, err := tx.CreateBucketIfNotExists([]byte("users"))
+	if err != nil {
+		return err
+	}
+	_, err = tx.CreateBucketIfNotExists([]byte("sessions"))
+	return err
+}
+
+func deserialiseUser(buf []byte) (User, error) {
+	var u User
+	err := gob.NewDecoder(bytes.NewBuffer(buf)).Decode(&u)
+	return u, err
+}
+
+func deserialiseSession(buf []byte) (Session, error) {
+	var s Session
+	err := gob.NewDecoder(bytes.NewBuffer(buf)).Decode(&s)
+	return s, err
+}
+
+// CreateUser adds a user, failing with ErrUserExists if the name is taken.
+// The first user created inherits the favourites chosen before chronoshot
+// had user accounts.
+func CreateUser(u User) error {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("users"))
+		if b.Get([]byte(u.Name)) != nil {
+			return ErrUserExists
+		}
+		if b.Stats().KeyN == 0 {
+			if err := adoptLegacySelections(tx, u.Name); err != nil {
+				return err
+			}
+		}
+		serialisedUser, err := serialise(u)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(u.Name), serialisedUser)
+	})
+}
+
+func adoptLegacySelections(tx *bolt.Tx, userName string) error {
+	legacy := tx.Bucket([]byte("selections"))
+	if legacy == nil {
+		return nil
+	}
+	b, err := tx.CreateBucketIfNotExists(selectionsBucket(userName))
+	if err != nil {
+		return err
+	}
+	err = legacy.ForEach(func(k, v []byte) error {
+		return b.Put(k, v)
+	})
+	if err != nil {
+		return err
+	}
+	return tx.DeleteBucket([]byte("selections"))
+}
+
+// SetPassword replaces a user's password hash and signs out their sessions.
+func SetPassword(name string, passwordHash []byte) error {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("users"))
+		u, err := deserialiseUser(b.Get([]byte(name)))
+		if err != nil {
+			return ErrUserNotFound
+		}
+		u.PasswordHash = passwordHash
+		serialisedUser, err := serialise(u)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(name), serialisedUser); err != nil {
+			return err
+		}
+		return deleteSessionsTx(tx, func(s Session) bool { return s.UserName == name })
+	})
+}
+
+func GetUser(name string) (User, bool) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var u User
+	found := false
+	err = db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket([]byte("users")).Get([]byte(name))
+		if buf == nil {
+			return nil
+		}
+		found = true
+		u, err = deserialiseUser(buf)
+		return err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return u, found
+}
+
+func GetUsers() []User {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var users []User
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("users")).ForEach(func(k, v []byte) error {
+			u, err := deserialiseUser(v)
+			if err != nil {
+				return err
+			}
+			users = append(users, u)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return users
+}
+
+// PutSession stores a session under a hash of its token; the token itself is
+// only ever held by the client.
+func PutSession(tokenHash []byte, s Session) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		// Tidy up while we are here.
+		now := time.Now()
+		if err := deleteSessionsTx(tx, func(s Session) bool { return now.After(s.Expires) }); err != nil {
+			return err
+		}
+
+		serialisedSession, err := serialise(s)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("sessions")).Put(tokenHash, serialisedSession)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// GetSession returns the unexpired session stored under tokenHash.
+func GetSession(tokenHash []byte) (Session, bool) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var s Session
+	found := false
+	err = db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket([]byte("sessions")).Get(tokenHash)
+		if buf == nil {
+			return nil
+		}
+		s, err = deserialiseSession(buf)
+		found = err == nil && time.Now().Before(s.Expires)
+		return err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return s, found
+}
+
+func DeleteSession(tokenHash []byte) {
+	db, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("sessions")).Delete(tokenHash)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func deleteSessionsTx(tx *bolt.Tx, match func(Session) bool) error {
+	b := tx.Bucket([]byte("sessions"))
+	var stale [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		s, err := deserialiseSession(v)
+		if err != nil || match(s) {
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range stale {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}